@@ -0,0 +1,195 @@
+package admin
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+
+	"gateway-go/apikey"
+	"gateway-go/credential"
+)
+
+// Handler serves the /admin API. Every request must carry "Authorization: Bearer <token>".
+type Handler struct {
+	token string
+	creds *credential.Manager
+	keys  *apikey.Manager
+	mux   *http.ServeMux
+}
+
+// NewHandler builds the admin API. keys may be nil when client authentication is off,
+// in which case the tenant and key routes are not served.
+func NewHandler(token string, creds *credential.Manager, keys *apikey.Manager) *Handler {
+	h := &Handler{
+		token: token,
+		creds: creds,
+		keys:  keys,
+		mux:   http.NewServeMux(),
+	}
+
+	h.mux.HandleFunc("GET /admin/credentials", h.listCredentials)
+	h.mux.HandleFunc("POST /admin/credentials", h.addCredential)
+	h.mux.HandleFunc("GET /admin/credentials/{id}", h.getCredential)
+	h.mux.HandleFunc("DELETE /admin/credentials/{id}", h.deleteCredential)
+	h.mux.HandleFunc("POST /admin/credentials/{id}/enable", h.setDisabled(false))
+	h.mux.HandleFunc("POST /admin/credentials/{id}/disable", h.setDisabled(true))
+	h.mux.HandleFunc("DELETE /admin/credentials/{id}/cooldowns", h.clearCooldowns)
+	h.mux.HandleFunc("POST /admin/credentials/{id}/refresh", h.refreshCredential)
+	h.mux.HandleFunc("PUT /admin/credentials/{id}/quotas", h.setQuotas)
+
+	if keys != nil {
+		h.mux.HandleFunc("GET /admin/tenants", h.listTenants)
+		h.mux.HandleFunc("GET /admin/tenants/{id}", h.getTenant)
+		h.mux.HandleFunc("PUT /admin/tenants/{id}", h.putTenant)
+		h.mux.HandleFunc("DELETE /admin/tenants/{id}", h.deleteTenant)
+		h.mux.HandleFunc("GET /admin/keys", h.listKeys)
+		h.mux.HandleFunc("POST /admin/keys", h.createKey)
+		h.mux.HandleFunc("GET /admin/keys/{id}", h.getKey)
+		h.mux.HandleFunc("DELETE /admin/keys/{id}", h.revokeKey)
+		h.mux.HandleFunc("POST /admin/keys/{id}/enable", h.setKeyDisabled(false))
+		h.mux.HandleFunc("POST /admin/keys/{id}/disable", h.setKeyDisabled(true))
+		h.mux.HandleFunc("PUT /admin/keys/{id}/limits", h.setKeyLimits)
+	}
+
+	return h
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !h.authorized(r) {
+		writeError(w, 401, "invalid admin token")
+		return
+	}
+	h.mux.ServeHTTP(w, r)
+}
+
+func (h *Handler) authorized(r *http.Request) bool {
+	got, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(got), []byte(h.token)) == 1
+}
+
+func (h *Handler) listCredentials(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, 200, map[string]any{"object": "list", "data": h.creds.List()})
+}
+
+func (h *Handler) getCredential(w http.ResponseWriter, r *http.Request) {
+	info, err := h.creds.Get(r.PathValue("id"))
+	if err != nil {
+		writeManagerError(w, err)
+		return
+	}
+	writeJSON(w, 200, info)
+}
+
+func (h *Handler) addCredential(w http.ResponseWriter, r *http.Request) {
+	var cred credential.Credential
+	if err := json.NewDecoder(r.Body).Decode(&cred); err != nil {
+		writeError(w, 400, "invalid request body")
+		return
+	}
+	if err := h.creds.Add(&cred); err != nil {
+		writeManagerError(w, err)
+		return
+	}
+	info, _ := h.creds.Get(cred.ID)
+	writeJSON(w, 201, info)
+}
+
+func (h *Handler) deleteCredential(w http.ResponseWriter, r *http.Request) {
+	if err := h.creds.Remove(r.PathValue("id")); err != nil {
+		writeManagerError(w, err)
+		return
+	}
+	w.WriteHeader(204)
+}
+
+func (h *Handler) setDisabled(disabled bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := r.PathValue("id")
+		if err := h.creds.SetDisabled(id, disabled); err != nil {
+			writeManagerError(w, err)
+			return
+		}
+		h.writeCredential(w, id)
+	}
+}
+
+// clearCooldowns clears every model cooldown, or only those named by ?model= (repeatable).
+func (h *Handler) clearCooldowns(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	if err := h.creds.ClearCooldowns(id, r.URL.Query()["model"]...); err != nil {
+		writeManagerError(w, err)
+		return
+	}
+	h.writeCredential(w, id)
+}
+
+func (h *Handler) refreshCredential(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	if err := h.creds.Refresh(id); err != nil {
+		if errors.Is(err, credential.ErrNotFound) {
+			writeManagerError(w, err)
+			return
+		}
+		writeError(w, 502, "refresh failed: "+err.Error())
+		return
+	}
+	h.writeCredential(w, id)
+}
+
+// setQuotas replaces the credential's limits with a body like {"*": {"rpm": 60}, "gemini-1.5-pro": {"rpd": 50}}.
+func (h *Handler) setQuotas(w http.ResponseWriter, r *http.Request) {
+	var quotas map[string]credential.Quota
+	if err := json.NewDecoder(r.Body).Decode(&quotas); err != nil {
+		writeError(w, 400, "invalid request body")
+		return
+	}
+	id := r.PathValue("id")
+	if err := h.creds.SetQuotas(id, quotas); err != nil {
+		writeManagerError(w, err)
+		return
+	}
+	h.writeCredential(w, id)
+}
+
+func (h *Handler) writeCredential(w http.ResponseWriter, id string) {
+	info, err := h.creds.Get(id)
+	if err != nil {
+		writeManagerError(w, err)
+		return
+	}
+	writeJSON(w, 200, info)
+}
+
+func writeManagerError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, credential.ErrNotFound):
+		writeError(w, 404, err.Error())
+	case errors.Is(err, credential.ErrExists):
+		writeError(w, 409, err.Error())
+	case errors.Is(err, credential.ErrInvalid):
+		writeError(w, 400, err.Error())
+	default:
+		writeError(w, 500, err.Error())
+	}
+}
+
+func writeJSON(w http.ResponseWriter, code int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, code int, msg string) {
+	writeJSON(w, code, map[string]any{
+		"error": map[string]any{
+			"message": msg,
+			"type":    "admin_error",
+			"code":    code,
+		},
+	})
+}
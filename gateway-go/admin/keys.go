@@ -0,0 +1,130 @@
+package admin
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"gateway-go/apikey"
+)
+
+func (h *Handler) listTenants(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, 200, map[string]any{"object": "list", "data": h.keys.Tenants()})
+}
+
+func (h *Handler) getTenant(w http.ResponseWriter, r *http.Request) {
+	t, err := h.keys.Tenant(r.PathValue("id"))
+	if err != nil {
+		writeKeyError(w, err)
+		return
+	}
+	writeJSON(w, 200, t)
+}
+
+// putTenant creates or updates a tenant with a body like {"allowed_models": ["gemini-2.0-flash"]}.
+// An empty or missing list allows every model.
+func (h *Handler) putTenant(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		AllowedModels []string `json:"allowed_models"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeError(w, 400, "invalid request body")
+		return
+	}
+	t, err := h.keys.PutTenant(r.PathValue("id"), body.AllowedModels)
+	if err != nil {
+		writeKeyError(w, err)
+		return
+	}
+	writeJSON(w, 200, t)
+}
+
+func (h *Handler) deleteTenant(w http.ResponseWriter, r *http.Request) {
+	if err := h.keys.DeleteTenant(r.PathValue("id")); err != nil {
+		writeKeyError(w, err)
+		return
+	}
+	w.WriteHeader(204)
+}
+
+func (h *Handler) listKeys(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, 200, map[string]any{"object": "list", "data": h.keys.Keys()})
+}
+
+func (h *Handler) getKey(w http.ResponseWriter, r *http.Request) {
+	info, err := h.keys.Key(r.PathValue("id"))
+	if err != nil {
+		writeKeyError(w, err)
+		return
+	}
+	writeJSON(w, 200, info)
+}
+
+// createKey issues a key for {"tenant": "<id>", "limits": {"rpm": 60, "tpd": 1000000}}.
+// The secret is only ever returned here.
+func (h *Handler) createKey(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Tenant string        `json:"tenant"`
+		Limits apikey.Limits `json:"limits"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeError(w, 400, "invalid request body")
+		return
+	}
+	info, secret, err := h.keys.Create(body.Tenant, body.Limits)
+	if err != nil {
+		writeKeyError(w, err)
+		return
+	}
+	writeJSON(w, 201, struct {
+		apikey.Info
+		Key string `json:"key"`
+	}{info, secret})
+}
+
+func (h *Handler) revokeKey(w http.ResponseWriter, r *http.Request) {
+	if err := h.keys.Revoke(r.PathValue("id")); err != nil {
+		writeKeyError(w, err)
+		return
+	}
+	w.WriteHeader(204)
+}
+
+func (h *Handler) setKeyDisabled(disabled bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		info, err := h.keys.SetDisabled(r.PathValue("id"), disabled)
+		if err != nil {
+			writeKeyError(w, err)
+			return
+		}
+		writeJSON(w, 200, info)
+	}
+}
+
+// setKeyLimits replaces the key's limits with a body like {"rpm": 60, "tpd": 1000000}.
+func (h *Handler) setKeyLimits(w http.ResponseWriter, r *http.Request) {
+	var limits apikey.Limits
+	if err := json.NewDecoder(r.Body).Decode(&limits); err != nil {
+		writeError(w, 400, "invalid request body")
+		return
+	}
+	info, err := h.keys.SetLimits(r.PathValue("id"), limits)
+	if err != nil {
+		writeKeyError(w, err)
+		return
+	}
+	writeJSON(w, 200, info)
+}
+
+func writeKeyError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, apikey.ErrNotFound):
+		writeError(w, 404, err.Error())
+	case errors.Is(err, apikey.ErrExists), errors.Is(err, apikey.ErrInUse):
+		writeError(w, 409, err.Error())
+	case errors.Is(err, apikey.ErrInvalid):
+		writeError(w, 400, err.Error())
+	default:
+		writeError(w, 500, err.Error())
+	}
+}
@@ -0,0 +1,203 @@
+package apikey
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"gateway-go/internal/window"
+)
+
+// Limits caps one key's consumption. Zero means unlimited.
+type Limits struct {
+	RPM int64 `json:"rpm,omitempty"` // requests per minute
+	TPD int64 `json:"tpd,omitempty"` // tokens (input + output) per day
+}
+
+// Usage is a key's consumption within the current sliding windows. Usage is kept in
+// memory only and starts from zero after a restart.
+type Usage struct {
+	RequestsMinute int64 `json:"requests_minute"`
+	TokensDay      int64 `json:"tokens_day"`
+}
+
+// keyUsage tracks one key's consumption.
+type keyUsage struct {
+	requestsMinute window.Counter
+	tokensDay      window.Counter
+}
+
+func newKeyUsage() *keyUsage {
+	return &keyUsage{
+		requestsMinute: window.New(time.Minute, time.Second),
+		tokensDay:      window.New(24*time.Hour, 15*time.Minute),
+	}
+}
+
+// limiter holds per-key usage for admission control.
+type limiter struct {
+	mu    sync.Mutex
+	usage map[string]*keyUsage
+}
+
+func (l *limiter) usageFor(keyID string) *keyUsage {
+	if l.usage == nil {
+		l.usage = make(map[string]*keyUsage)
+	}
+	u, ok := l.usage[keyID]
+	if !ok {
+		u = newKeyUsage()
+		l.usage[keyID] = u
+	}
+	return u
+}
+
+func (l *limiter) current(keyID string, now time.Time) Usage {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	u, ok := l.usage[keyID]
+	if !ok {
+		return Usage{}
+	}
+	return Usage{RequestsMinute: u.requestsMinute.Sum(now), TokensDay: u.tokensDay.Sum(now)}
+}
+
+func (l *limiter) forget(keyID string) {
+	l.mu.Lock()
+	delete(l.usage, keyID)
+	l.mu.Unlock()
+}
+
+// Decision is the outcome of an admission check, with the figures reported in the
+// x-ratelimit-* headers.
+type Decision struct {
+	Allowed bool
+	Limits  Limits
+	Usage   Usage // including this request if it was admitted
+
+	// ResetRequests and ResetTokens are how long until the request and token windows
+	// are empty again. RetryAfter is set when the request was rejected.
+	ResetRequests time.Duration
+	ResetTokens   time.Duration
+	RetryAfter    time.Duration
+	Reason        string // "requests" or "tokens" when rejected
+}
+
+// Reservation holds the tokens estimated at admission until the request settles.
+type Reservation struct {
+	l        *limiter
+	keyID    string
+	at       time.Time
+	estimate int64
+	once     sync.Once
+}
+
+// Settle replaces the admission estimate with what the request actually used.
+// Only the first call has an effect; a nil Reservation is a no-op.
+func (r *Reservation) Settle(actualTokens int) {
+	if r == nil {
+		return
+	}
+	r.once.Do(func() {
+		r.l.mu.Lock()
+		defer r.l.mu.Unlock()
+		// Charged to the admission bucket so the window expires it on time
+		r.l.usageFor(r.keyID).tokensDay.Add(r.at, int64(actualTokens)-r.estimate)
+	})
+}
+
+// Admit checks a request estimated at estimatedTokens against the key's limits and,
+// if it fits, counts it and reserves the tokens. Settle the reservation when the
+// request finishes. Keys without limits are always admitted.
+func (m *Manager) Admit(keyID string, estimatedTokens int) (*Reservation, Decision) {
+	m.mu.RLock()
+	k, ok := m.keys[keyID]
+	var limits Limits
+	if ok {
+		limits = k.Limits
+	}
+	m.mu.RUnlock()
+
+	if limits == (Limits{}) {
+		return nil, Decision{Allowed: true}
+	}
+
+	now := time.Now()
+	est := int64(estimatedTokens)
+
+	m.limiter.mu.Lock()
+	defer m.limiter.mu.Unlock()
+
+	u := m.limiter.usageFor(keyID)
+	used := Usage{RequestsMinute: u.requestsMinute.Sum(now), TokensDay: u.tokensDay.Sum(now)}
+	d := Decision{Limits: limits, Usage: used}
+
+	if limits.RPM > 0 && used.RequestsMinute+1 > limits.RPM {
+		d.Reason = "requests"
+		d.RetryAfter = u.requestsMinute.WaitFor(now, used.RequestsMinute+1-limits.RPM)
+	} else if limits.TPD > 0 && used.TokensDay+est > limits.TPD {
+		d.Reason = "tokens"
+		d.RetryAfter = u.tokensDay.WaitFor(now, used.TokensDay+est-limits.TPD)
+	}
+
+	if d.Reason == "" {
+		d.Allowed = true
+		u.requestsMinute.Add(now, 1)
+		u.tokensDay.Add(now, est)
+		d.Usage.RequestsMinute++
+		d.Usage.TokensDay += est
+	}
+	// Resets are until the window is empty again, as OpenAI reports them
+	d.ResetRequests = u.requestsMinute.WaitFor(now, d.Usage.RequestsMinute)
+	d.ResetTokens = u.tokensDay.WaitFor(now, d.Usage.TokensDay)
+
+	if !d.Allowed {
+		return nil, d
+	}
+	return &Reservation{l: &m.limiter, keyID: keyID, at: now, estimate: est}, d
+}
+
+// SetHeaders writes the x-ratelimit-* headers for every limited dimension.
+func (d Decision) SetHeaders(h http.Header) {
+	if d.Limits.RPM > 0 {
+		h.Set("x-ratelimit-limit-requests", strconv.FormatInt(d.Limits.RPM, 10))
+		h.Set("x-ratelimit-remaining-requests", strconv.FormatInt(max(d.Limits.RPM-d.Usage.RequestsMinute, 0), 10))
+		h.Set("x-ratelimit-reset-requests", formatReset(d.ResetRequests))
+	}
+	if d.Limits.TPD > 0 {
+		h.Set("x-ratelimit-limit-tokens", strconv.FormatInt(d.Limits.TPD, 10))
+		h.Set("x-ratelimit-remaining-tokens", strconv.FormatInt(max(d.Limits.TPD-d.Usage.TokensDay, 0), 10))
+		h.Set("x-ratelimit-reset-tokens", formatReset(d.ResetTokens))
+	}
+}
+
+// WriteRejection writes the OpenAI-style 429 for a rejected Decision.
+func (d Decision) WriteRejection(w http.ResponseWriter) {
+	d.SetHeaders(w.Header())
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(d.RetryAfter.Seconds()))))
+
+	var msg string
+	if d.Reason == "requests" {
+		msg = fmt.Sprintf("Rate limit reached for requests per minute: limit %d, used %d. Please try again in %s.",
+			d.Limits.RPM, d.Usage.RequestsMinute, formatReset(d.RetryAfter))
+	} else {
+		msg = fmt.Sprintf("Rate limit reached for tokens per day: limit %d, used %d. Please try again in %s.",
+			d.Limits.TPD, d.Usage.TokensDay, formatReset(d.RetryAfter))
+	}
+	WriteError(w, 429, d.Reason, "rate_limit_exceeded", msg)
+}
+
+// formatReset renders a duration the way OpenAI's reset headers do, e.g. "1s", "6m0s".
+func formatReset(d time.Duration) string {
+	if d <= 0 {
+		return "0s"
+	}
+	if d < time.Second {
+		return d.Round(time.Millisecond).String()
+	}
+	return d.Round(time.Second).String()
+}
@@ -0,0 +1,122 @@
+package apikey
+
+import (
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// newKey opens a key file in a temp dir and creates one key with limits.
+func newKey(t *testing.T, limits Limits) (*Manager, string) {
+	t.Helper()
+	m, err := Open(filepath.Join(t.TempDir(), "keys.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.PutTenant("acme", nil); err != nil {
+		t.Fatal(err)
+	}
+	info, _, err := m.Create("acme", limits)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m, info.ID
+}
+
+func TestAdmitUnlimited(t *testing.T) {
+	m, id := newKey(t, Limits{})
+	for i := 0; i < 100; i++ {
+		res, d := m.Admit(id, 1_000_000)
+		if !d.Allowed || res != nil {
+			t.Fatalf("request %d: allowed %v, reservation %v", i, d.Allowed, res)
+		}
+	}
+	// A nil reservation settles as a no-op
+	var res *Reservation
+	res.Settle(10)
+}
+
+func TestAdmitRequestsPerMinute(t *testing.T) {
+	m, id := newKey(t, Limits{RPM: 2})
+	for i := 0; i < 2; i++ {
+		if _, d := m.Admit(id, 10); !d.Allowed {
+			t.Fatalf("request %d rejected: %s", i+1, d.Reason)
+		}
+	}
+	_, d := m.Admit(id, 10)
+	if d.Allowed || d.Reason != "requests" {
+		t.Fatalf("third request: allowed %v, reason %q", d.Allowed, d.Reason)
+	}
+	if d.RetryAfter <= 0 || d.RetryAfter > time.Minute {
+		t.Errorf("RetryAfter = %v", d.RetryAfter)
+	}
+	if got := m.limiter.current(id, time.Now()).RequestsMinute; got != 2 {
+		t.Errorf("rejected request counted: %d requests used", got)
+	}
+}
+
+func TestReservationSettle(t *testing.T) {
+	m, id := newKey(t, Limits{TPD: 1000})
+	used := func() int64 { return m.limiter.current(id, time.Now()).TokensDay }
+
+	first, d := m.Admit(id, 600)
+	if !d.Allowed || d.Usage.TokensDay != 600 {
+		t.Fatalf("first: allowed %v, usage %+v", d.Allowed, d.Usage)
+	}
+	// The estimate stays reserved until the request settles
+	if _, d := m.Admit(id, 600); d.Allowed || d.Reason != "tokens" {
+		t.Fatalf("second while first reserved: allowed %v, reason %q", d.Allowed, d.Reason)
+	}
+
+	first.Settle(100)
+	if got := used(); got != 100 {
+		t.Fatalf("after settling at 100, %d tokens used", got)
+	}
+	first.Settle(900) // only the first Settle counts
+	if got := used(); got != 100 {
+		t.Fatalf("second Settle changed usage to %d", got)
+	}
+
+	second, d := m.Admit(id, 600)
+	if !d.Allowed {
+		t.Fatalf("second after settle rejected: %s", d.Reason)
+	}
+	second.Settle(0) // refunded: nothing was delivered
+	if got := used(); got != 100 {
+		t.Errorf("after refund, %d tokens used", got)
+	}
+
+	third, _ := m.Admit(id, 100)
+	third.Settle(1500) // a request may overrun its estimate
+	if _, d := m.Admit(id, 1); d.Allowed || d.RetryAfter <= 0 {
+		t.Errorf("over budget: allowed %v, RetryAfter %v", d.Allowed, d.RetryAfter)
+	}
+}
+
+func TestDecisionHeaders(t *testing.T) {
+	m, id := newKey(t, Limits{RPM: 1, TPD: 1000})
+	_, d := m.Admit(id, 250)
+	rec := httptest.NewRecorder()
+	d.SetHeaders(rec.Header())
+	for name, want := range map[string]string{
+		"x-ratelimit-limit-requests":     "1",
+		"x-ratelimit-remaining-requests": "0",
+		"x-ratelimit-limit-tokens":       "1000",
+		"x-ratelimit-remaining-tokens":   "750",
+	} {
+		if got := rec.Header().Get(name); got != want {
+			t.Errorf("%s = %q, want %q", name, got, want)
+		}
+	}
+
+	_, d = m.Admit(id, 250)
+	rec = httptest.NewRecorder()
+	d.WriteRejection(rec)
+	if rec.Code != 429 {
+		t.Errorf("status = %d, want 429", rec.Code)
+	}
+	if ra := rec.Header().Get("Retry-After"); ra == "" || ra == "0" {
+		t.Errorf("Retry-After = %q", ra)
+	}
+}
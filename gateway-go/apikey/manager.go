@@ -0,0 +1,406 @@
+package apikey
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"gateway-go/internal/fsutil"
+)
+
+// secretPrefix marks gateway-issued keys so they are recognisable in logs and configs.
+const secretPrefix = "sk-gw-"
+
+var (
+	ErrNotFound = errors.New("not found")
+	ErrExists   = errors.New("already exists")
+	ErrInvalid  = errors.New("invalid request")
+	ErrInUse    = errors.New("tenant still has keys")
+)
+
+// Tenant groups keys and limits which models they may call. An empty AllowedModels
+// allows every model.
+type Tenant struct {
+	ID            string    `json:"id"`
+	AllowedModels []string  `json:"allowed_models,omitempty"`
+	CreatedAt     time.Time `json:"created_at"`
+}
+
+// Allows reports whether the tenant may call model.
+func (t *Tenant) Allows(model string) bool {
+	if len(t.AllowedModels) == 0 {
+		return true
+	}
+	for _, m := range t.AllowedModels {
+		if m == model {
+			return true
+		}
+	}
+	return false
+}
+
+// Key is a gateway-issued API key. Only the SHA-256 of the secret is stored; the
+// secret itself is returned once, by Create.
+type Key struct {
+	ID        string    `json:"id"`
+	Tenant    string    `json:"tenant"`
+	Hash      string    `json:"hash"`
+	Prefix    string    `json:"prefix"` // first characters of the secret, for display
+	Disabled  bool      `json:"disabled"`
+	Limits    Limits    `json:"limits"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Info is the admin view of a key. The hash is never included.
+type Info struct {
+	ID        string    `json:"id"`
+	Tenant    string    `json:"tenant"`
+	Prefix    string    `json:"prefix"`
+	Disabled  bool      `json:"disabled"`
+	Limits    Limits    `json:"limits"`
+	Usage     Usage     `json:"usage"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// info builds the admin view of k. Caller must hold m.mu.
+func (m *Manager) info(k *Key) Info {
+	return Info{
+		ID:        k.ID,
+		Tenant:    k.Tenant,
+		Prefix:    k.Prefix,
+		Disabled:  k.Disabled,
+		Limits:    k.Limits,
+		Usage:     m.limiter.current(k.ID, time.Now()),
+		CreatedAt: k.CreatedAt,
+	}
+}
+
+// Principal is the authenticated caller of a request.
+type Principal struct {
+	KeyID  string
+	Tenant Tenant
+}
+
+// Allows reports whether the caller may use model.
+func (p *Principal) Allows(model string) bool {
+	return p.Tenant.Allows(model)
+}
+
+// fileData is the on-disk layout of the key file.
+type fileData struct {
+	Tenants []*Tenant `json:"tenants"`
+	Keys    []*Key    `json:"keys"`
+}
+
+// Manager holds tenants and keys, persisting every change to a single JSON file.
+// Changes are rare admin operations, so the whole file is rewritten each time.
+type Manager struct {
+	mu      sync.RWMutex
+	path    string
+	tenants map[string]*Tenant
+	keys    map[string]*Key // by ID
+	byHash  map[string]*Key
+	limiter limiter
+}
+
+// Open loads the key file at path, creating an empty one if it does not exist.
+func Open(path string) (*Manager, error) {
+	m := &Manager{
+		path:    path,
+		tenants: make(map[string]*Tenant),
+		keys:    make(map[string]*Key),
+		byHash:  make(map[string]*Key),
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+			return nil, fmt.Errorf("create key dir: %w", err)
+		}
+		return m, m.save()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var fd fileData
+	if err := json.Unmarshal(data, &fd); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", path, err)
+	}
+	for _, t := range fd.Tenants {
+		m.tenants[t.ID] = t
+	}
+	for _, k := range fd.Keys {
+		m.keys[k.ID] = k
+		m.byHash[k.Hash] = k
+	}
+	return m, nil
+}
+
+// save writes the key file atomically. Caller must hold m.mu for writing.
+func (m *Manager) save() error {
+	fd := fileData{Tenants: []*Tenant{}, Keys: []*Key{}}
+	for _, t := range m.tenants {
+		fd.Tenants = append(fd.Tenants, t)
+	}
+	for _, k := range m.keys {
+		fd.Keys = append(fd.Keys, k)
+	}
+	sort.Slice(fd.Tenants, func(i, j int) bool { return fd.Tenants[i].ID < fd.Tenants[j].ID })
+	sort.Slice(fd.Keys, func(i, j int) bool { return fd.Keys[i].ID < fd.Keys[j].ID })
+
+	data, err := json.MarshalIndent(fd, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if err := fsutil.WriteFileAtomic(m.path, data); err != nil {
+		return err
+	}
+	return fsutil.SyncDir(filepath.Dir(m.path))
+}
+
+// Authenticate resolves a presented secret to its caller. It fails for unknown or
+// disabled keys.
+func (m *Manager) Authenticate(secret string) (*Principal, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	k, ok := m.byHash[hashSecret(secret)]
+	if !ok || k.Disabled {
+		return nil, ErrNotFound
+	}
+	t, ok := m.tenants[k.Tenant]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	p := &Principal{KeyID: k.ID, Tenant: *t}
+	p.Tenant.AllowedModels = append([]string(nil), t.AllowedModels...)
+	return p, nil
+}
+
+// Tenants returns every tenant, sorted by ID.
+func (m *Manager) Tenants() []Tenant {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	list := make([]Tenant, 0, len(m.tenants))
+	for _, t := range m.tenants {
+		list = append(list, *t)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	return list
+}
+
+// Tenant returns one tenant.
+func (m *Manager) Tenant(id string) (Tenant, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	t, ok := m.tenants[id]
+	if !ok {
+		return Tenant{}, fmt.Errorf("tenant %s: %w", id, ErrNotFound)
+	}
+	return *t, nil
+}
+
+// PutTenant creates a tenant or replaces its allowed models.
+func (m *Manager) PutTenant(id string, allowedModels []string) (Tenant, error) {
+	if !fsutil.ValidName(id) {
+		return Tenant{}, fmt.Errorf("%w: tenant id may only contain letters, digits, '.', '_' and '-'", ErrInvalid)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	t, ok := m.tenants[id]
+	prev := Tenant{}
+	if ok {
+		prev = *t
+	} else {
+		t = &Tenant{ID: id, CreatedAt: time.Now().UTC()}
+		m.tenants[id] = t
+	}
+	t.AllowedModels = allowedModels
+	if err := m.save(); err != nil {
+		if ok {
+			*t = prev
+		} else {
+			delete(m.tenants, id)
+		}
+		return Tenant{}, err
+	}
+	return *t, nil
+}
+
+// DeleteTenant removes a tenant that has no keys left.
+func (m *Manager) DeleteTenant(id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	t, ok := m.tenants[id]
+	if !ok {
+		return fmt.Errorf("tenant %s: %w", id, ErrNotFound)
+	}
+	for _, k := range m.keys {
+		if k.Tenant == id {
+			return fmt.Errorf("tenant %s: %w", id, ErrInUse)
+		}
+	}
+	delete(m.tenants, id)
+	if err := m.save(); err != nil {
+		m.tenants[id] = t
+		return err
+	}
+	return nil
+}
+
+// Keys returns every key, sorted by ID.
+func (m *Manager) Keys() []Info {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	list := make([]Info, 0, len(m.keys))
+	for _, k := range m.keys {
+		list = append(list, m.info(k))
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	return list
+}
+
+// Key returns one key.
+func (m *Manager) Key(id string) (Info, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	k, ok := m.keys[id]
+	if !ok {
+		return Info{}, fmt.Errorf("key %s: %w", id, ErrNotFound)
+	}
+	return m.info(k), nil
+}
+
+// Create issues a new key for tenant and returns it with its secret.
+func (m *Manager) Create(tenant string, limits Limits) (Info, string, error) {
+	if limits.RPM < 0 || limits.TPD < 0 {
+		return Info{}, "", fmt.Errorf("%w: negative limit", ErrInvalid)
+	}
+	secret, err := randomHex(24)
+	if err != nil {
+		return Info{}, "", err
+	}
+	secret = secretPrefix + secret
+	id, err := randomHex(6)
+	if err != nil {
+		return Info{}, "", err
+	}
+	id = "key_" + id
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.tenants[tenant]; !ok {
+		return Info{}, "", fmt.Errorf("%w: unknown tenant %q", ErrInvalid, tenant)
+	}
+	if _, ok := m.keys[id]; ok {
+		return Info{}, "", fmt.Errorf("key %s: %w", id, ErrExists)
+	}
+
+	k := &Key{
+		ID:        id,
+		Tenant:    tenant,
+		Hash:      hashSecret(secret),
+		Prefix:    secret[:len(secretPrefix)+4],
+		Limits:    limits,
+		CreatedAt: time.Now().UTC(),
+	}
+	m.keys[k.ID] = k
+	m.byHash[k.Hash] = k
+	if err := m.save(); err != nil {
+		delete(m.keys, k.ID)
+		delete(m.byHash, k.Hash)
+		return Info{}, "", err
+	}
+	return m.info(k), secret, nil
+}
+
+// Revoke deletes a key; requests using it fail immediately.
+func (m *Manager) Revoke(id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	k, ok := m.keys[id]
+	if !ok {
+		return fmt.Errorf("key %s: %w", id, ErrNotFound)
+	}
+	delete(m.keys, id)
+	delete(m.byHash, k.Hash)
+	if err := m.save(); err != nil {
+		m.keys[id] = k
+		m.byHash[k.Hash] = k
+		return err
+	}
+	m.limiter.forget(id)
+	return nil
+}
+
+// SetDisabled enables or disables a key without revoking it.
+func (m *Manager) SetDisabled(id string, disabled bool) (Info, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	k, ok := m.keys[id]
+	if !ok {
+		return Info{}, fmt.Errorf("key %s: %w", id, ErrNotFound)
+	}
+	prev := k.Disabled
+	k.Disabled = disabled
+	if err := m.save(); err != nil {
+		k.Disabled = prev
+		return Info{}, err
+	}
+	return m.info(k), nil
+}
+
+// SetLimits replaces a key's limits. Usage already counted is kept.
+func (m *Manager) SetLimits(id string, limits Limits) (Info, error) {
+	if limits.RPM < 0 || limits.TPD < 0 {
+		return Info{}, fmt.Errorf("%w: negative limit", ErrInvalid)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	k, ok := m.keys[id]
+	if !ok {
+		return Info{}, fmt.Errorf("key %s: %w", id, ErrNotFound)
+	}
+	prev := k.Limits
+	k.Limits = limits
+	if err := m.save(); err != nil {
+		k.Limits = prev
+		return Info{}, err
+	}
+	return m.info(k), nil
+}
+
+func hashSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+func randomHex(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
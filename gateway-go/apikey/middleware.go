@@ -0,0 +1,48 @@
+package apikey
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+type contextKey struct{}
+
+// FromContext returns the authenticated caller, or nil when authentication is off.
+func FromContext(ctx context.Context) *Principal {
+	p, _ := ctx.Value(contextKey{}).(*Principal)
+	return p
+}
+
+// Middleware rejects requests without a valid "Authorization: Bearer <key>" and
+// makes the caller available to next through FromContext.
+func (m *Manager) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		secret, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || secret == "" {
+			WriteError(w, 401, "invalid_request_error", "missing_api_key",
+				"You didn't provide an API key. Send it in the Authorization header as 'Bearer <key>'.")
+			return
+		}
+		p, err := m.Authenticate(secret)
+		if err != nil {
+			WriteError(w, 401, "invalid_request_error", "invalid_api_key", "Incorrect API key provided.")
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), contextKey{}, p)))
+	})
+}
+
+// WriteError writes an OpenAI-style error body.
+func WriteError(w http.ResponseWriter, status int, errType, code, msg string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]any{
+		"error": map[string]any{
+			"message": msg,
+			"type":    errType,
+			"code":    code,
+		},
+	})
+}
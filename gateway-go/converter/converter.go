@@ -1,6 +1,7 @@
 package converter
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"strings"
@@ -8,23 +9,35 @@ import (
 
 // OpenAI request/response types
 type OpenAIRequest struct {
-	Model            string           `json:"model"`
-	Messages         []OpenAIMessage  `json:"messages"`
-	Temperature      *float64         `json:"temperature,omitempty"`
-	TopP             *float64         `json:"top_p,omitempty"`
-	MaxTokens        *int             `json:"max_tokens,omitempty"`
-	Stop             []string         `json:"stop,omitempty"`
-	Stream           bool             `json:"stream"`
-	Tools            []OpenAITool     `json:"tools,omitempty"`
-	ToolChoice       any              `json:"tool_choice,omitempty"`
+	Model             string           `json:"model"`
+	Messages          []OpenAIMessage  `json:"messages"`
+	Temperature       *float64         `json:"temperature,omitempty"`
+	TopP              *float64         `json:"top_p,omitempty"`
+	MaxTokens         *int             `json:"max_tokens,omitempty"`
+	Stop              []string         `json:"stop,omitempty"`
+	Stream            bool             `json:"stream"`
+	Tools             []OpenAITool     `json:"tools,omitempty"`
+	ToolChoice        any              `json:"tool_choice,omitempty"`
+	ParallelToolCalls *bool            `json:"parallel_tool_calls,omitempty"`
+	Functions         []OpenAIFunction `json:"functions,omitempty"`     // legacy form of tools
+	FunctionCall      any              `json:"function_call,omitempty"` // legacy form of tool_choice
+	ResponseFormat    *ResponseFormat  `json:"response_format,omitempty"`
+	StreamOptions     *StreamOptions   `json:"stream_options,omitempty"`
+	User              string           `json:"user,omitempty"`
+	AntiTruncation    string           `json:"anti_truncation,omitempty"` // gateway extension, e.g. "off" or "marker:5"
+}
+
+type StreamOptions struct {
+	IncludeUsage bool `json:"include_usage"` // send a final chunk with the whole response's usage
 }
 
 type OpenAIMessage struct {
-	Role       string          `json:"role"`
-	Content    any             `json:"content"` // string or []ContentPart
-	ToolCalls  []OpenAIToolCall `json:"tool_calls,omitempty"`
-	ToolCallID string          `json:"tool_call_id,omitempty"`
-	Name       string          `json:"name,omitempty"`
+	Role         string              `json:"role"`
+	Content      any                 `json:"content"` // string or []ContentPart
+	ToolCalls    []OpenAIToolCall    `json:"tool_calls,omitempty"`
+	FunctionCall *OpenAIFunctionCall `json:"function_call,omitempty"` // legacy form of tool_calls
+	ToolCallID   string              `json:"tool_call_id,omitempty"`
+	Name         string              `json:"name,omitempty"`
 }
 
 type OpenAITool struct {
@@ -50,21 +63,47 @@ type OpenAIFunctionCall struct {
 }
 
 type OpenAIResponse struct {
-	ID      string          `json:"id"`
-	Object  string          `json:"object"`
-	Created int64           `json:"created"`
-	Model   string          `json:"model"`
-	Choices []OpenAIChoice  `json:"choices"`
-	Usage   *OpenAIUsage    `json:"usage,omitempty"`
+	ID                string         `json:"id"`
+	Object            string         `json:"object"`
+	Created           int64          `json:"created"`
+	Model             string         `json:"model"`
+	SystemFingerprint string         `json:"system_fingerprint,omitempty"`
+	Choices           []OpenAIChoice `json:"choices"`
+	Usage             *OpenAIUsage   `json:"usage,omitempty"`
 }
 
 type OpenAIChoice struct {
 	Index        int            `json:"index"`
 	Message      *OpenAIMessage `json:"message,omitempty"`
-	Delta        *OpenAIMessage `json:"delta,omitempty"`
+	Delta        *OpenAIDelta   `json:"delta,omitempty"`
 	FinishReason *string        `json:"finish_reason"`
 }
 
+// OpenAIDelta is the part of a message carried by one streamed chunk. Unlike a
+// message, absent fields are left out rather than sent as null.
+type OpenAIDelta struct {
+	Role      string                `json:"role,omitempty"`
+	Content   *string               `json:"content,omitempty"`
+	ToolCalls []OpenAIToolCallDelta `json:"tool_calls,omitempty"`
+
+	FunctionCall *OpenAIFunctionCallDelta `json:"function_call,omitempty"` // legacy form of ToolCalls
+}
+
+// OpenAIToolCallDelta is a piece of a streamed tool call. The first piece of a call
+// has its ID, type and name; later pieces with the same Index carry argument text
+// to append.
+type OpenAIToolCallDelta struct {
+	Index    int                     `json:"index"`
+	ID       string                  `json:"id,omitempty"`
+	Type     string                  `json:"type,omitempty"`
+	Function OpenAIFunctionCallDelta `json:"function"`
+}
+
+type OpenAIFunctionCallDelta struct {
+	Name      string `json:"name,omitempty"`
+	Arguments string `json:"arguments"`
+}
+
 type OpenAIUsage struct {
 	PromptTokens     int `json:"prompt_tokens"`
 	CompletionTokens int `json:"completion_tokens"`
@@ -89,6 +128,20 @@ type GeminiPart struct {
 	Text         string                 `json:"text,omitempty"`
 	FunctionCall *GeminiFunctionCall    `json:"functionCall,omitempty"`
 	FunctionResp *GeminiFunctionResp    `json:"functionResponse,omitempty"`
+	InlineData   *GeminiBlob            `json:"inlineData,omitempty"`
+	FileData     *GeminiFileData        `json:"fileData,omitempty"`
+}
+
+// GeminiBlob is media sent inline, base64-encoded.
+type GeminiBlob struct {
+	MimeType string `json:"mimeType"`
+	Data     string `json:"data"`
+}
+
+// GeminiFileData is media Gemini reads itself, from the Files API or Cloud Storage.
+type GeminiFileData struct {
+	MimeType string `json:"mimeType,omitempty"`
+	FileURI  string `json:"fileUri"`
 }
 
 type GeminiFunctionCall struct {
@@ -116,7 +169,8 @@ type GeminiToolConfig struct {
 }
 
 type FunctionCallingConfig struct {
-	Mode string `json:"mode"`
+	Mode                 string   `json:"mode"`
+	AllowedFunctionNames []string `json:"allowedFunctionNames,omitempty"` // mode ANY only
 }
 
 type GeminiResponse struct {
@@ -136,24 +190,28 @@ type GeminiUsage struct {
 	TotalTokenCount      int `json:"totalTokenCount"`
 }
 
-// OpenAIToGemini converts an OpenAI chat completion request to Gemini format.
-func OpenAIToGemini(req *OpenAIRequest) (*GeminiRequest, error) {
+// OpenAIToGemini converts an OpenAI chat completion request to Gemini format. Media
+// referenced by http(s) URL is downloaded with fetch; a nil fetch rejects it.
+func OpenAIToGemini(ctx context.Context, req *OpenAIRequest, fetch *MediaFetcher) (*GeminiRequest, error) {
 	gemReq := &GeminiRequest{}
 
 	// Convert messages to contents
 	var contents []GeminiContent
-	for _, msg := range req.Messages {
+	var system []string
+	names := toolNames(req.Messages)
+	for i, msg := range req.Messages {
 		switch msg.Role {
-		case "system":
-			text := ExtractTextContent(msg.Content)
-			gemReq.SystemInstruction = &GeminiContent{
-				Parts: []GeminiPart{{Text: text}},
-				Role:  "user",
+		case "system", "developer":
+			if text := ExtractTextContent(msg.Content); text != "" {
+				system = append(system, text)
 			}
 		case "user":
-			text := ExtractTextContent(msg.Content)
+			parts, err := userParts(ctx, msg.Content, fetch)
+			if err != nil {
+				return nil, err
+			}
 			contents = append(contents, GeminiContent{
-				Parts: []GeminiPart{{Text: text}},
+				Parts: parts,
 				Role:  "user",
 			})
 		case "assistant":
@@ -172,13 +230,30 @@ func OpenAIToGemini(req *OpenAIRequest) (*GeminiRequest, error) {
 					},
 				})
 			}
+			if fc := msg.FunctionCall; fc != nil {
+				var args map[string]any
+				json.Unmarshal([]byte(fc.Arguments), &args)
+				parts = append(parts, GeminiPart{
+					FunctionCall: &GeminiFunctionCall{Name: fc.Name, Args: args},
+				})
+			}
 			if len(parts) > 0 {
 				contents = append(contents, GeminiContent{
 					Parts: parts,
 					Role:  "model",
 				})
 			}
-		case "tool":
+		case "tool", "function":
+			name := names[msg.ToolCallID]
+			if name == "" {
+				name = msg.Name
+			}
+			if name == "" && msg.Role == "function" {
+				return nil, fmt.Errorf("messages[%d]: function message without a name", i)
+			}
+			if name == "" {
+				return nil, fmt.Errorf("messages[%d]: tool_call_id %q matches no tool call of an earlier assistant message", i, msg.ToolCallID)
+			}
 			var respData map[string]any
 			text := ExtractTextContent(msg.Content)
 			if err := json.Unmarshal([]byte(text), &respData); err != nil {
@@ -187,15 +262,26 @@ func OpenAIToGemini(req *OpenAIRequest) (*GeminiRequest, error) {
 			contents = append(contents, GeminiContent{
 				Parts: []GeminiPart{{
 					FunctionResp: &GeminiFunctionResp{
-						Name:     msg.Name,
+						Name:     name,
 						Response: respData,
 					},
 				}},
 				Role: "user",
 			})
+		default:
+			return nil, fmt.Errorf("messages[%d]: unknown role %q", i, msg.Role)
 		}
 	}
-	gemReq.Contents = contents
+	if len(system) > 0 {
+		gemReq.SystemInstruction = &GeminiContent{
+			Parts: []GeminiPart{{Text: strings.Join(system, "\n\n")}},
+			Role:  "user",
+		}
+	}
+	gemReq.Contents = MergeTurns(contents)
+	if err := validateTurns(gemReq.Contents); err != nil {
+		return nil, err
+	}
 
 	// Convert generation config
 	genConfig := map[string]any{}
@@ -211,42 +297,20 @@ func OpenAIToGemini(req *OpenAIRequest) (*GeminiRequest, error) {
 	if len(req.Stop) > 0 {
 		genConfig["stopSequences"] = req.Stop
 	}
+	if err := req.ResponseFormat.apply(genConfig); err != nil {
+		return nil, err
+	}
 	if len(genConfig) > 0 {
 		gemReq.GenerationConfig = genConfig
 	}
 
-	// Convert tools
-	if len(req.Tools) > 0 {
-		var decls []GeminiFuncDecl
-		for _, tool := range req.Tools {
-			params := CleanSchemaForGemini(tool.Function.Parameters)
-			decls = append(decls, GeminiFuncDecl{
-				Name:        tool.Function.Name,
-				Description: tool.Function.Description,
-				Parameters:  params,
-			})
-		}
-		gemReq.Tools = []GeminiToolDef{{FunctionDeclarations: decls}}
-	}
-
-	// Convert tool_choice
-	if req.ToolChoice != nil {
-		mode := "AUTO"
-		switch v := req.ToolChoice.(type) {
-		case string:
-			switch v {
-			case "auto":
-				mode = "AUTO"
-			case "none":
-				mode = "NONE"
-			case "required":
-				mode = "ANY"
-			}
-		}
-		gemReq.ToolConfig = &GeminiToolConfig{
-			FunctionCallingConfig: &FunctionCallingConfig{Mode: mode},
-		}
+	// Convert tools and tool_choice
+	tools, toolConfig, err := convertTools(req)
+	if err != nil {
+		return nil, err
 	}
+	gemReq.Tools = tools
+	gemReq.ToolConfig = toolConfig
 
 	return gemReq, nil
 }
@@ -254,10 +318,11 @@ func OpenAIToGemini(req *OpenAIRequest) (*GeminiRequest, error) {
 // GeminiToOpenAI converts a Gemini response to OpenAI format.
 func GeminiToOpenAI(gemResp *GeminiResponse, model string, reqID string) *OpenAIResponse {
 	resp := &OpenAIResponse{
-		ID:      reqID,
-		Object:  "chat.completion",
-		Created: 0, // Will be set by caller
-		Model:   model,
+		ID:                reqID,
+		Object:            "chat.completion",
+		Created:           0, // Will be set by caller
+		Model:             model,
+		SystemFingerprint: SystemFingerprint(model),
 	}
 
 	for _, cand := range gemResp.Candidates {
@@ -273,15 +338,7 @@ func GeminiToOpenAI(gemResp *GeminiResponse, model string, reqID string) *OpenAI
 				textParts = append(textParts, part.Text)
 			}
 			if part.FunctionCall != nil {
-				argsJSON, _ := json.Marshal(part.FunctionCall.Args)
-				msg.ToolCalls = append(msg.ToolCalls, OpenAIToolCall{
-					ID:   fmt.Sprintf("call_%s", part.FunctionCall.Name),
-					Type: "function",
-					Function: OpenAIFunctionCall{
-						Name:      part.FunctionCall.Name,
-						Arguments: string(argsJSON),
-					},
-				})
+				msg.ToolCalls = append(msg.ToolCalls, toolCall(reqID, cand.Index, len(msg.ToolCalls), part.FunctionCall))
 			}
 		}
 
@@ -293,7 +350,7 @@ func GeminiToOpenAI(gemResp *GeminiResponse, model string, reqID string) *OpenAI
 		choice.Message = msg
 
 		if cand.FinishReason != "" {
-			fr := mapFinishReason(cand.FinishReason)
+			fr := finishReason(cand.FinishReason, len(msg.ToolCalls) > 0)
 			choice.FinishReason = &fr
 		}
 
@@ -311,64 +368,13 @@ func GeminiToOpenAI(gemResp *GeminiResponse, model string, reqID string) *OpenAI
 	return resp
 }
 
-// GeminiChunkToOpenAIChunk converts a single Gemini streaming chunk to OpenAI SSE format.
-func GeminiChunkToOpenAIChunk(gemResp *GeminiResponse, model string, reqID string) *OpenAIResponse {
-	resp := &OpenAIResponse{
-		ID:      reqID,
-		Object:  "chat.completion.chunk",
-		Created: 0,
-		Model:   model,
-	}
-
-	for _, cand := range gemResp.Candidates {
-		choice := OpenAIChoice{
-			Index: cand.Index,
-		}
-
-		delta := &OpenAIMessage{Role: "assistant"}
-		var textParts []string
-
-		for _, part := range cand.Content.Parts {
-			if part.Text != "" {
-				textParts = append(textParts, part.Text)
-			}
-			if part.FunctionCall != nil {
-				argsJSON, _ := json.Marshal(part.FunctionCall.Args)
-				delta.ToolCalls = append(delta.ToolCalls, OpenAIToolCall{
-					ID:   fmt.Sprintf("call_%s", part.FunctionCall.Name),
-					Type: "function",
-					Function: OpenAIFunctionCall{
-						Name:      part.FunctionCall.Name,
-						Arguments: string(argsJSON),
-					},
-				})
-			}
-		}
-
-		if len(textParts) > 0 {
-			combined := strings.Join(textParts, "")
-			delta.Content = combined
-		}
-
-		choice.Delta = delta
-
-		if cand.FinishReason != "" {
-			fr := mapFinishReason(cand.FinishReason)
-			choice.FinishReason = &fr
-		}
-
-		resp.Choices = append(resp.Choices, choice)
+// finishReason maps a Gemini finish reason, reporting a normal stop after function
+// calls as "tool_calls" like OpenAI does.
+func finishReason(geminiReason string, toolCalls bool) string {
+	if toolCalls && (geminiReason == "STOP" || geminiReason == "") {
+		return "tool_calls"
 	}
-
-	if gemResp.UsageMetadata != nil {
-		resp.Usage = &OpenAIUsage{
-			PromptTokens:     gemResp.UsageMetadata.PromptTokenCount,
-			CompletionTokens: gemResp.UsageMetadata.CandidatesTokenCount,
-			TotalTokens:      gemResp.UsageMetadata.TotalTokenCount,
-		}
-	}
-
-	return resp
+	return mapFinishReason(geminiReason)
 }
 
 func mapFinishReason(geminiReason string) string {
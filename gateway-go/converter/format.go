@@ -0,0 +1,83 @@
+package converter
+
+import (
+	"fmt"
+	"strings"
+)
+
+// ResponseFormat is the response_format of a request: "text", "json_object" for
+// JSON mode, or "json_schema" for structured outputs.
+type ResponseFormat struct {
+	Type       string      `json:"type"`
+	JSONSchema *JSONSchema `json:"json_schema,omitempty"`
+}
+
+type JSONSchema struct {
+	Name        string         `json:"name"`
+	Description string         `json:"description,omitempty"`
+	Schema      map[string]any `json:"schema,omitempty"`
+	Strict      *bool          `json:"strict,omitempty"`
+}
+
+// JSON reports whether the response must be JSON. A nil format is plain text.
+func (f *ResponseFormat) JSON() bool {
+	return f != nil && (f.Type == "json_object" || f.Type == "json_schema")
+}
+
+// apply sets Gemini's JSON output options in genConfig. The schema is sent cleaned
+// for Gemini; Validate checks against the original.
+func (f *ResponseFormat) apply(genConfig map[string]any) error {
+	if f == nil {
+		return nil
+	}
+	switch f.Type {
+	case "", "text":
+	case "json_object":
+		genConfig["responseMimeType"] = "application/json"
+	case "json_schema":
+		if f.JSONSchema == nil || f.JSONSchema.Schema == nil {
+			return fmt.Errorf("response_format: json_schema requires a schema")
+		}
+		genConfig["responseMimeType"] = "application/json"
+		genConfig["responseSchema"] = responseSchema(f.JSONSchema.Schema)
+	default:
+		return fmt.Errorf("response_format: unsupported type %q", f.Type)
+	}
+	return nil
+}
+
+// responseSchema cleans a json_schema for Gemini's responseSchema, which, unlike
+// function parameters, rejects additionalProperties. Strict schemas set it on every
+// object, so it is dropped throughout; Validate still enforces it.
+func responseSchema(schema map[string]any) map[string]any {
+	cleaned := CleanSchemaForGemini(schema)
+	dropAdditionalProperties(cleaned)
+	return cleaned
+}
+
+func dropAdditionalProperties(schema map[string]any) {
+	delete(schema, "additionalProperties")
+	if props, ok := schema["properties"].(map[string]any); ok {
+		for _, p := range props {
+			if pm, ok := p.(map[string]any); ok {
+				dropAdditionalProperties(pm)
+			}
+		}
+	}
+	if items, ok := schema["items"].(map[string]any); ok {
+		dropAdditionalProperties(items)
+	}
+}
+
+// Validate checks a response's text against the format: it must be JSON, matching
+// the schema for json_schema.
+func (f *ResponseFormat) Validate(text string) error {
+	if !f.JSON() {
+		return nil
+	}
+	var schema map[string]any
+	if f.Type == "json_schema" {
+		schema = f.JSONSchema.Schema
+	}
+	return ValidateJSON([]byte(strings.TrimSpace(text)), schema)
+}
@@ -0,0 +1,186 @@
+package converter
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestResponseFormatTranslation(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		format   string
+		mimeType string
+		schema   string // expected responseSchema, as JSON; empty for none
+		err      string
+	}{
+		{"absent", ``, "", "", ""},
+		{"text", `{"type": "text"}`, "", "", ""},
+		{"json_object", `{"type": "json_object"}`, "application/json", "", ""},
+		{
+			name: "json_schema",
+			format: `{"type": "json_schema", "json_schema": {"name": "person", "strict": true, "schema": {
+				"type": "object",
+				"properties": {
+					"name": {"type": "string"},
+					"address": {"$ref": "#/$defs/address"},
+					"tags": {"type": "array", "items": {"type": "object", "properties": {"v": {"type": "string"}}, "additionalProperties": false}}
+				},
+				"required": ["name"],
+				"additionalProperties": false,
+				"$defs": {"address": {"type": "object", "properties": {"city": {"type": "string"}}, "additionalProperties": false}}
+			}}}`,
+			mimeType: "application/json",
+			schema: `{"type": "OBJECT", "required": ["name"], "properties": {
+				"name": {"type": "STRING"},
+				"address": {"type": "OBJECT", "properties": {"city": {"type": "STRING"}}},
+				"tags": {"type": "ARRAY", "items": {"type": "OBJECT", "properties": {"v": {"type": "STRING"}}}}
+			}}`,
+		},
+		{"json_schema without schema", `{"type": "json_schema", "json_schema": {"name": "x"}}`, "", "", "requires a schema"},
+		{"unknown type", `{"type": "yaml"}`, "", "", `unsupported type "yaml"`},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			req := &OpenAIRequest{
+				Model:    "gemini-2.0-flash",
+				Messages: []OpenAIMessage{{Role: "user", Content: "hi"}},
+			}
+			if tc.format != "" {
+				if err := json.Unmarshal([]byte(tc.format), &req.ResponseFormat); err != nil {
+					t.Fatal(err)
+				}
+			}
+			gemReq, err := OpenAIToGemini(context.Background(), req, nil)
+			if tc.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.err) {
+					t.Fatalf("error = %v, want one containing %q", err, tc.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			mimeType, _ := gemReq.GenerationConfig["responseMimeType"].(string)
+			if mimeType != tc.mimeType {
+				t.Errorf("responseMimeType = %q, want %q", mimeType, tc.mimeType)
+			}
+			schema, hasSchema := gemReq.GenerationConfig["responseSchema"]
+			if tc.schema == "" {
+				if hasSchema {
+					t.Errorf("unexpected responseSchema %v", schema)
+				}
+				return
+			}
+			got, _ := json.Marshal(schema)
+			var want any
+			json.Unmarshal([]byte(tc.schema), &want)
+			wantJSON, _ := json.Marshal(want)
+			if string(got) != string(wantJSON) {
+				t.Errorf("responseSchema =\n%s\nwant\n%s", got, wantJSON)
+			}
+		})
+	}
+}
+
+// Tool parameter schemas keep additionalProperties; only response schemas drop it.
+func TestToolSchemaKeepsAdditionalProperties(t *testing.T) {
+	params := decodeSchema(t, `{"type": "object", "properties": {"q": {"type": "string"}}, "additionalProperties": false}`)
+	if _, ok := CleanSchemaForGemini(params)["additionalProperties"]; !ok {
+		t.Error("additionalProperties dropped from a tool schema")
+	}
+}
+
+func TestResponseFormatValidate(t *testing.T) {
+	strictTrue := true
+	schemaFormat := &ResponseFormat{Type: "json_schema", JSONSchema: &JSONSchema{
+		Name:   "answer",
+		Strict: &strictTrue,
+		Schema: decodeSchema(t, `{"type": "object", "properties": {"answer": {"type": "integer"}}, "required": ["answer"], "additionalProperties": false}`),
+	}}
+	for _, tc := range []struct {
+		name   string
+		format *ResponseFormat
+		text   string
+		valid  bool
+	}{
+		{"no format", nil, "anything", true},
+		{"text", &ResponseFormat{Type: "text"}, "anything", true},
+		{"json_object", &ResponseFormat{Type: "json_object"}, ` {"a": 1}` + "\n", true},
+		{"json_object prose", &ResponseFormat{Type: "json_object"}, "Here you go: {}", false},
+		{"json_object fenced", &ResponseFormat{Type: "json_object"}, "```json\n{}\n```", false},
+		{"json_schema", schemaFormat, `{"answer": 42}`, true},
+		{"json_schema mismatch", schemaFormat, `{"answer": "42"}`, false},
+		{"json_schema extra", schemaFormat, `{"answer": 42, "why": "because"}`, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			err := tc.format.Validate(tc.text)
+			if (err == nil) != tc.valid {
+				t.Errorf("Validate(%q) = %v, want valid %v", tc.text, err, tc.valid)
+			}
+		})
+	}
+}
+
+func TestInlineRefs(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		schema string
+		want   string
+	}{
+		{
+			name:   "defs",
+			schema: `{"type": "object", "properties": {"a": {"$ref": "#/$defs/x"}}, "$defs": {"x": {"type": "string"}}}`,
+			want:   `{"type": "OBJECT", "properties": {"a": {"type": "STRING"}}}`,
+		},
+		{
+			name:   "definitions with sibling description",
+			schema: `{"type": "object", "properties": {"a": {"$ref": "#/definitions/x", "description": "the a"}}, "definitions": {"x": {"type": "integer"}}}`,
+			want:   `{"type": "OBJECT", "properties": {"a": {"type": "INTEGER", "description": "the a"}}}`,
+		},
+		{
+			name:   "escaped pointer",
+			schema: `{"type": "object", "properties": {"a": {"$ref": "#/$defs/a~1b"}}, "$defs": {"a/b": {"type": "boolean"}}}`,
+			want:   `{"type": "OBJECT", "properties": {"a": {"type": "BOOLEAN"}}}`,
+		},
+		{
+			name:   "unresolvable",
+			schema: `{"type": "object", "properties": {"a": {"$ref": "#/$defs/missing"}}}`,
+			want:   `{"type": "OBJECT", "properties": {"a": {"type": "OBJECT"}}}`,
+		},
+		{
+			name:   "remote refs are not followed",
+			schema: `{"type": "object", "properties": {"a": {"$ref": "https://example.com/schema.json"}}}`,
+			want:   `{"type": "OBJECT", "properties": {"a": {"type": "OBJECT"}}}`,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got, _ := json.Marshal(CleanSchemaForGemini(decodeSchema(t, tc.schema)))
+			want, _ := json.Marshal(decodeSchema(t, tc.want))
+			if string(got) != string(want) {
+				t.Errorf("got %s, want %s", got, want)
+			}
+		})
+	}
+}
+
+// A recursive schema is expanded maxRefDepth levels deep and then cut off.
+func TestInlineRefsRecursive(t *testing.T) {
+	schema := decodeSchema(t, `{"$ref": "#/$defs/node", "$defs": {"node": {
+		"type": "object", "properties": {"next": {"$ref": "#/$defs/node"}}
+	}}}`)
+	node := CleanSchemaForGemini(schema)
+	depth := 0
+	for {
+		props, ok := node["properties"].(map[string]any)
+		if !ok {
+			break
+		}
+		node = props["next"].(map[string]any)
+		depth++
+	}
+	if depth != maxRefDepth {
+		t.Errorf("expanded %d levels, want %d", depth, maxRefDepth)
+	}
+}
@@ -0,0 +1,369 @@
+package converter
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// DefaultMaxMediaBytes caps one media item, matching Gemini's limit on inline data.
+const DefaultMaxMediaBytes = 20 << 20
+
+// ContentPart is one element of an OpenAI message's content array.
+type ContentPart struct {
+	Type       string      `json:"type"`
+	Text       string      `json:"text,omitempty"`
+	ImageURL   *ImageURL   `json:"image_url,omitempty"`
+	InputAudio *InputAudio `json:"input_audio,omitempty"`
+	File       *FilePart   `json:"file,omitempty"`
+}
+
+type ImageURL struct {
+	URL    string `json:"url"` // data: URL or http(s) URL
+	Detail string `json:"detail,omitempty"`
+}
+
+type InputAudio struct {
+	Data   string `json:"data"`   // base64
+	Format string `json:"format"` // "wav" or "mp3"
+}
+
+type FilePart struct {
+	FileData string `json:"file_data,omitempty"` // data: URL
+	FileID   string `json:"file_id,omitempty"`
+	Filename string `json:"filename,omitempty"`
+}
+
+// contentParts decodes a message's content; plain string content is one text part.
+func contentParts(content any) ([]ContentPart, error) {
+	switch v := content.(type) {
+	case nil:
+		return nil, nil
+	case string:
+		return []ContentPart{{Type: "text", Text: v}}, nil
+	}
+	data, _ := json.Marshal(content)
+	var parts []ContentPart
+	if err := json.Unmarshal(data, &parts); err != nil {
+		return nil, fmt.Errorf("content must be a string or an array of content parts")
+	}
+	return parts, nil
+}
+
+// userParts converts a user message's content to Gemini parts.
+func userParts(ctx context.Context, content any, fetch *MediaFetcher) ([]GeminiPart, error) {
+	parts, err := contentParts(content)
+	if err != nil {
+		return nil, err
+	}
+	// Inline data keeps Gemini's cap; fetch.MaxBytes only limits what is downloaded
+	const maxBytes = DefaultMaxMediaBytes
+
+	out := []GeminiPart{}
+	for _, p := range parts {
+		switch p.Type {
+		case "text":
+			out = append(out, GeminiPart{Text: p.Text})
+		case "image_url":
+			if p.ImageURL == nil {
+				return nil, fmt.Errorf("image_url part without image_url")
+			}
+			part, err := mediaPart(ctx, p.ImageURL.URL, fetch, maxBytes)
+			if err != nil {
+				return nil, fmt.Errorf("image_url: %w", err)
+			}
+			if mt := part.mimeType(); !strings.HasPrefix(mt, "image/") {
+				return nil, fmt.Errorf("image_url: %s is not an image", mt)
+			}
+			out = append(out, part)
+		case "input_audio":
+			if p.InputAudio == nil {
+				return nil, fmt.Errorf("input_audio part without input_audio")
+			}
+			if p.InputAudio.Format != "wav" && p.InputAudio.Format != "mp3" {
+				return nil, fmt.Errorf("input_audio: unsupported format %q", p.InputAudio.Format)
+			}
+			if err := checkBase64(p.InputAudio.Data, maxBytes); err != nil {
+				return nil, fmt.Errorf("input_audio: %w", err)
+			}
+			out = append(out, GeminiPart{InlineData: &GeminiBlob{
+				MimeType: "audio/" + p.InputAudio.Format,
+				Data:     p.InputAudio.Data,
+			}})
+		case "file":
+			if p.File == nil {
+				return nil, fmt.Errorf("file part without file")
+			}
+			part, err := filePart(p.File, maxBytes)
+			if err != nil {
+				return nil, fmt.Errorf("file: %w", err)
+			}
+			out = append(out, part)
+		default:
+			return nil, fmt.Errorf("unsupported content part type %q", p.Type)
+		}
+	}
+	if len(out) == 0 {
+		out = append(out, GeminiPart{})
+	}
+	return out, nil
+}
+
+func (p GeminiPart) mimeType() string {
+	switch {
+	case p.InlineData != nil:
+		return p.InlineData.MimeType
+	case p.FileData != nil:
+		return p.FileData.MimeType
+	}
+	return ""
+}
+
+// mediaPart converts a media URL. Data URLs are sent inline, Cloud Storage and Files
+// API URIs by reference, and other http(s) URLs are downloaded and sent inline.
+func mediaPart(ctx context.Context, url string, fetch *MediaFetcher, maxBytes int64) (GeminiPart, error) {
+	switch {
+	case strings.HasPrefix(url, "data:"):
+		blob, err := parseDataURL(url, maxBytes)
+		if err != nil {
+			return GeminiPart{}, err
+		}
+		return GeminiPart{InlineData: blob}, nil
+	case isFileURI(url):
+		return GeminiPart{FileData: &GeminiFileData{MimeType: mimeFromName(url), FileURI: url}}, nil
+	case strings.HasPrefix(url, "http://"), strings.HasPrefix(url, "https://"):
+		if fetch == nil {
+			return GeminiPart{}, fmt.Errorf("remote media URLs are not enabled")
+		}
+		blob, err := fetch.Fetch(ctx, url)
+		if err != nil {
+			return GeminiPart{}, err
+		}
+		return GeminiPart{InlineData: blob}, nil
+	}
+	return GeminiPart{}, fmt.Errorf("unsupported URL scheme")
+}
+
+// filePart converts a file part: inline file data, or a file ID that is a Cloud
+// Storage or Files API URI. OpenAI file IDs mean nothing to Gemini.
+func filePart(f *FilePart, maxBytes int64) (GeminiPart, error) {
+	switch {
+	case f.FileData != "":
+		blob, err := parseDataURL(f.FileData, maxBytes)
+		if err != nil {
+			return GeminiPart{}, err
+		}
+		return GeminiPart{InlineData: blob}, nil
+	case isFileURI(f.FileID):
+		mt := mimeFromName(f.Filename)
+		if mt == "" {
+			mt = mimeFromName(f.FileID)
+		}
+		return GeminiPart{FileData: &GeminiFileData{MimeType: mt, FileURI: f.FileID}}, nil
+	case f.FileID != "":
+		return GeminiPart{}, fmt.Errorf("file_id %q is not a Gemini file URI", f.FileID)
+	}
+	return GeminiPart{}, fmt.Errorf("file_data or file_id required")
+}
+
+// isFileURI reports whether uri names a file Gemini can read without our help.
+func isFileURI(uri string) bool {
+	return strings.HasPrefix(uri, "gs://") ||
+		strings.HasPrefix(uri, "https://generativelanguage.googleapis.com/")
+}
+
+func mimeFromName(name string) string {
+	if i := strings.LastIndexByte(name, '.'); i >= 0 {
+		mt, _, _ := mime.ParseMediaType(mime.TypeByExtension(name[i:]))
+		return mt
+	}
+	return ""
+}
+
+// parseDataURL decodes "data:<mime type>;base64,<data>".
+func parseDataURL(url string, maxBytes int64) (*GeminiBlob, error) {
+	meta, data, ok := strings.Cut(strings.TrimPrefix(url, "data:"), ",")
+	if !ok {
+		return nil, fmt.Errorf("malformed data URL")
+	}
+	mt, ok := strings.CutSuffix(meta, ";base64")
+	if !ok {
+		return nil, fmt.Errorf("data URL must be base64-encoded")
+	}
+	if mt == "" {
+		return nil, fmt.Errorf("data URL without a media type")
+	}
+	if err := checkBase64(data, maxBytes); err != nil {
+		return nil, err
+	}
+	return &GeminiBlob{MimeType: mt, Data: data}, nil
+}
+
+func checkBase64(data string, maxBytes int64) error {
+	if int64(base64.StdEncoding.DecodedLen(len(data))) > maxBytes+2 {
+		return fmt.Errorf("media larger than %d bytes", maxBytes)
+	}
+	if _, err := base64.StdEncoding.DecodeString(data); err != nil {
+		return fmt.Errorf("invalid base64 data")
+	}
+	return nil
+}
+
+// MediaFetcher downloads media that requests reference by http(s) URL, so it can be
+// sent to Gemini inline. It only connects to public addresses: the URL comes from
+// the client, and the gateway must not become a way into the network it runs in.
+type MediaFetcher struct {
+	Client   *http.Client
+	MaxBytes int64 // per fetched item; inline data is capped at DefaultMaxMediaBytes
+}
+
+// maxMediaRedirects caps the redirects followed for one media URL.
+const maxMediaRedirects = 3
+
+func NewMediaFetcher(maxBytes int64) *MediaFetcher {
+	// The address is checked after DNS resolution, at connect time, so a name
+	// that resolves to a public address once and a private one later gets nowhere.
+	dialer := &net.Dialer{
+		Timeout: 10 * time.Second,
+		Control: func(network, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			if ip := net.ParseIP(host); ip == nil || !publicIP(ip) {
+				return fmt.Errorf("address %s is not public", host)
+			}
+			return nil
+		},
+	}
+	transport := &http.Transport{
+		Proxy:                 nil, // a proxy would make the dialer check the proxy, not the target
+		DialContext:           dialer.DialContext,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ResponseHeaderTimeout: 10 * time.Second,
+		MaxIdleConns:          10,
+		IdleConnTimeout:       30 * time.Second,
+	}
+	return &MediaFetcher{
+		Client: &http.Client{
+			Transport: transport,
+			Timeout:   30 * time.Second,
+			CheckRedirect: func(req *http.Request, via []*http.Request) error {
+				if len(via) > maxMediaRedirects {
+					return fmt.Errorf("more than %d redirects", maxMediaRedirects)
+				}
+				return checkMediaURL(req.URL)
+			},
+		},
+		MaxBytes: maxBytes,
+	}
+}
+
+// checkMediaURL rejects URLs the fetcher will not follow. Host names are left to
+// the dialer, which sees the address they resolve to.
+func checkMediaURL(u *url.URL) error {
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("unsupported URL scheme %q", u.Scheme)
+	}
+	host := u.Hostname()
+	if host == "" {
+		return fmt.Errorf("URL without a host")
+	}
+	if ip := net.ParseIP(host); ip != nil && !publicIP(ip) {
+		return fmt.Errorf("address %s is not public", host)
+	}
+	return nil
+}
+
+// nonPublic lists ranges net.IP's predicates do not cover.
+var nonPublic = []*net.IPNet{
+	mustCIDR("0.0.0.0/8"),     // "this network"
+	mustCIDR("100.64.0.0/10"), // carrier-grade NAT
+	mustCIDR("192.0.0.0/24"),  // IETF protocol assignments
+	mustCIDR("198.18.0.0/15"), // benchmarking
+	mustCIDR("240.0.0.0/4"),   // reserved, including broadcast
+	mustCIDR("64:ff9b::/96"),  // NAT64, which can reach any IPv4 address
+}
+
+func mustCIDR(s string) *net.IPNet {
+	_, n, err := net.ParseCIDR(s)
+	if err != nil {
+		panic(err)
+	}
+	return n
+}
+
+// publicIP reports whether ip is a globally routable unicast address: not loopback,
+// private (RFC 1918, or IPv6 unique local), link-local (which holds cloud metadata
+// services), multicast or unspecified.
+func publicIP(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() || ip.IsMulticast() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() {
+		return false
+	}
+	for _, n := range nonPublic {
+		if n.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// Fetch downloads url, refusing anything over MaxBytes.
+func (f *MediaFetcher) Fetch(ctx context.Context, url string) (*GeminiBlob, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkMediaURL(req.URL); err != nil {
+		return nil, fmt.Errorf("fetch %s: %w", url, err)
+	}
+	resp, err := f.Client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("fetch %s: %w", url, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetch %s: status %d", url, resp.StatusCode)
+	}
+	if resp.ContentLength > f.MaxBytes {
+		return nil, fmt.Errorf("fetch %s: larger than %d bytes", url, f.MaxBytes)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, f.MaxBytes+1))
+	if err != nil {
+		return nil, fmt.Errorf("fetch %s: %w", url, err)
+	}
+	if int64(len(data)) > f.MaxBytes {
+		return nil, fmt.Errorf("fetch %s: larger than %d bytes", url, f.MaxBytes)
+	}
+
+	mt, _, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if err != nil || mt == "application/octet-stream" {
+		mt, _, _ = mime.ParseMediaType(http.DetectContentType(data))
+	}
+	return &GeminiBlob{MimeType: mt, Data: base64.StdEncoding.EncodeToString(data)}, nil
+}
+
+// CountImages returns how many images a request's messages carry.
+func CountImages(req *OpenAIRequest) int {
+	n := 0
+	for _, msg := range req.Messages {
+		parts, _ := contentParts(msg.Content)
+		for _, p := range parts {
+			if p.Type == "image_url" {
+				n++
+			}
+		}
+	}
+	return n
+}
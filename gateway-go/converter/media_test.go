@@ -0,0 +1,98 @@
+package converter
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestPublicIP(t *testing.T) {
+	for _, tc := range []struct {
+		ip   string
+		want bool
+	}{
+		{"8.8.8.8", true},
+		{"2001:4860:4860::8888", true},
+		{"127.0.0.1", false},
+		{"::1", false},
+		{"10.1.2.3", false},
+		{"172.16.0.1", false},
+		{"192.168.1.1", false},
+		{"169.254.169.254", false},
+		{"fe80::1", false},
+		{"fd00:ec2::254", false},
+		{"0.0.0.0", false},
+		{"100.64.0.1", false},
+		{"::ffff:127.0.0.1", false},
+		{"64:ff9b::a9fe:a9fe", false},
+	} {
+		if got := publicIP(net.ParseIP(tc.ip)); got != tc.want {
+			t.Errorf("publicIP(%s) = %v, want %v", tc.ip, got, tc.want)
+		}
+	}
+}
+
+func TestFetchRejectsInternalAddresses(t *testing.T) {
+	hit := false
+	internal := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hit = true
+		w.Header().Set("Content-Type", "image/png")
+		w.Write([]byte("\x89PNG\r\n\x1a\n"))
+	}))
+	defer internal.Close()
+	port := internal.URL[strings.LastIndexByte(internal.URL, ':'):]
+
+	f := NewMediaFetcher(1 << 20)
+	for _, url := range []string{
+		internal.URL + "/health",
+		"http://localhost" + port + "/health", // resolved before the check
+		"http://[::1]" + port + "/health",
+		"http://169.254.169.254/latest/meta-data/",
+		"ftp://example.com/cat.png",
+	} {
+		if _, err := f.Fetch(context.Background(), url); err == nil {
+			t.Errorf("Fetch(%s) succeeded", url)
+		}
+	}
+	if hit {
+		t.Error("internal server was reached")
+	}
+}
+
+func TestFetchChecksRedirects(t *testing.T) {
+	f := NewMediaFetcher(1 << 20)
+	redirect := f.Client.CheckRedirect
+
+	req := httptest.NewRequest("GET", "http://127.0.0.1/secret", nil)
+	if err := redirect(req, make([]*http.Request, 1)); err == nil {
+		t.Error("redirect to loopback allowed")
+	}
+	req = httptest.NewRequest("GET", "http://93.184.216.34/cat.png", nil)
+	if err := redirect(req, make([]*http.Request, 1)); err != nil {
+		t.Errorf("redirect to public address: %v", err)
+	}
+	if err := redirect(req, make([]*http.Request, maxMediaRedirects+1)); err == nil {
+		t.Error("redirect chain not capped")
+	}
+}
+
+// The fetcher's size limit applies to downloads only; inline data keeps Gemini's cap.
+func TestInlineMediaCapIgnoresFetchLimit(t *testing.T) {
+	f := NewMediaFetcher(16)
+	image := func(size int) any {
+		data := strings.Repeat("A", (size+2)/3*4)
+		return []any{map[string]any{"type": "image_url", "image_url": map[string]any{"url": "data:image/png;base64," + data}}}
+	}
+	for _, fetch := range []*MediaFetcher{nil, f} {
+		if _, err := userParts(context.Background(), image(1024), fetch); err != nil {
+			t.Errorf("fetcher %v: 1KB inline image rejected: %v", fetch != nil, err)
+		}
+		_, err := userParts(context.Background(), image(DefaultMaxMediaBytes+1024), fetch)
+		if err == nil || !strings.Contains(err.Error(), "media larger than") {
+			t.Errorf("fetcher %v: oversized inline image: %v", fetch != nil, err)
+		}
+	}
+}
@@ -11,7 +11,62 @@ func CleanSchemaForGemini(schema map[string]any) map[string]any {
 		return nil
 	}
 	visited := make(map[string]bool)
-	return cleanSchemaRecursive(schema, visited)
+	inlined, _ := inlineRefs(schema, schema, 0).(map[string]any)
+	return cleanSchemaRecursive(inlined, visited)
+}
+
+// maxRefDepth bounds how deep recursive $refs are expanded; Gemini schemas can't
+// refer to themselves, so deeper levels become plain objects.
+const maxRefDepth = 8
+
+// inlineRefs replaces local $refs ("#/$defs/x", "#/definitions/x") with the schemas
+// they point to, keeping sibling keywords such as description.
+func inlineRefs(node any, root map[string]any, depth int) any {
+	switch v := node.(type) {
+	case map[string]any:
+		out := make(map[string]any, len(v))
+		if ref, ok := v["$ref"].(string); ok {
+			target := resolveRef(root, ref)
+			if target == nil || depth >= maxRefDepth {
+				target = map[string]any{"type": "object"}
+			}
+			for k, tv := range inlineRefs(target, root, depth+1).(map[string]any) {
+				out[k] = tv
+			}
+		}
+		for k, child := range v {
+			if k != "$ref" {
+				out[k] = inlineRefs(child, root, depth)
+			}
+		}
+		return out
+	case []any:
+		out := make([]any, len(v))
+		for i, child := range v {
+			out[i] = inlineRefs(child, root, depth)
+		}
+		return out
+	default:
+		return node
+	}
+}
+
+// resolveRef follows a local JSON pointer such as "#/$defs/address" from root.
+func resolveRef(root map[string]any, ref string) map[string]any {
+	path, ok := strings.CutPrefix(ref, "#/")
+	if !ok {
+		return nil
+	}
+	node := root
+	for _, key := range strings.Split(path, "/") {
+		key = strings.ReplaceAll(strings.ReplaceAll(key, "~1", "/"), "~0", "~")
+		next, ok := node[key].(map[string]any)
+		if !ok {
+			return nil
+		}
+		node = next
+	}
+	return node
 }
 
 func cleanSchemaRecursive(schema map[string]any, visited map[string]bool) map[string]any {
@@ -0,0 +1,184 @@
+package converter
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+	"unicode/utf8"
+)
+
+// SystemFingerprint identifies the backend configuration serving model. It is the
+// same for every response from this gateway for a given model.
+func SystemFingerprint(model string) string {
+	sum := sha256.Sum256([]byte("gateway-go/" + model))
+	return "fp_" + hex.EncodeToString(sum[:5])
+}
+
+// StreamConverter converts one streamed response, possibly spread over several
+// upstream requests, into OpenAI chunks the way OpenAI streams them: every chunk
+// shares the ID, creation time and system fingerprint, each choice opens with a
+// chunk carrying only the role, and its finish reason comes once, after all content,
+// in a chunk with an empty delta. Usage, when asked for, follows in a final chunk
+// without choices.
+type StreamConverter struct {
+	Calls CallStyle // how tool calls are streamed
+
+	id          string
+	model       string
+	fingerprint string
+	created     int64
+	started     map[int]bool
+	finish      map[int]string // latest Gemini finish reason per choice
+	calls       map[int]int    // tool calls sent per choice
+	order       []int          // choice indexes in the order they started
+}
+
+// NewStreamConverter starts a stream for model. created is the Unix time every chunk
+// reports.
+func NewStreamConverter(model, reqID string, created int64) *StreamConverter {
+	return &StreamConverter{
+		id:          reqID,
+		model:       model,
+		fingerprint: SystemFingerprint(model),
+		created:     created,
+		started:     make(map[int]bool),
+		finish:      make(map[int]string),
+		calls:       make(map[int]int),
+	}
+}
+
+func (c *StreamConverter) chunk(choices []OpenAIChoice) *OpenAIResponse {
+	return &OpenAIResponse{
+		ID:                c.id,
+		Object:            "chat.completion.chunk",
+		Created:           c.created,
+		Model:             c.model,
+		SystemFingerprint: c.fingerprint,
+		Choices:           choices,
+	}
+}
+
+// argumentFragment is the most argument bytes one tool call delta carries.
+const argumentFragment = 32
+
+// Convert turns one Gemini chunk into the OpenAI chunks to send, which may be none.
+// Finish reasons are only noted: a continuation may still follow, so they are sent
+// by Finish.
+func (c *StreamConverter) Convert(gemResp *GeminiResponse) []*OpenAIResponse {
+	var chunks []*OpenAIResponse
+
+	for _, cand := range gemResp.Candidates {
+		if cand.FinishReason != "" {
+			c.finish[cand.Index] = cand.FinishReason
+		}
+
+		var text strings.Builder
+		flushText := func() {
+			if text.Len() == 0 {
+				return
+			}
+			content := text.String()
+			text.Reset()
+			chunks = c.open(chunks, cand.Index)
+			chunks = append(chunks, c.delta(cand.Index, &OpenAIDelta{Content: &content}))
+		}
+		for _, part := range cand.Content.Parts {
+			if part.Text != "" {
+				text.WriteString(part.Text)
+			}
+			if part.FunctionCall != nil {
+				flushText()
+				chunks = c.open(chunks, cand.Index)
+				chunks = append(chunks, c.toolCallDeltas(cand.Index, part.FunctionCall)...)
+			}
+		}
+		flushText()
+	}
+	return chunks
+}
+
+// open appends the chunk that opens choice, carrying only the role, unless it was
+// already sent.
+func (c *StreamConverter) open(chunks []*OpenAIResponse, choice int) []*OpenAIResponse {
+	if c.started[choice] {
+		return chunks
+	}
+	c.started[choice] = true
+	c.order = append(c.order, choice)
+	empty := ""
+	return append(chunks, c.delta(choice, &OpenAIDelta{Role: "assistant", Content: &empty}))
+}
+
+func (c *StreamConverter) delta(choice int, delta *OpenAIDelta) *OpenAIResponse {
+	return c.chunk([]OpenAIChoice{{Index: choice, Delta: delta}})
+}
+
+// toolCallDeltas streams one function call the way OpenAI does: a delta with the
+// call's index, ID and name and empty arguments, then the arguments in fragments
+// that clients concatenate.
+func (c *StreamConverter) toolCallDeltas(choice int, fc *GeminiFunctionCall) []*OpenAIResponse {
+	n := c.calls[choice]
+	if c.Calls.Single && n > 0 {
+		return nil
+	}
+	c.calls[choice]++
+	call := toolCall(c.id, choice, n, fc)
+
+	piece := func(fn OpenAIFunctionCallDelta, first bool) *OpenAIDelta {
+		if c.Calls.Legacy {
+			return &OpenAIDelta{FunctionCall: &fn}
+		}
+		d := OpenAIToolCallDelta{Index: n, Function: fn}
+		if first {
+			d.ID, d.Type = call.ID, call.Type
+		}
+		return &OpenAIDelta{ToolCalls: []OpenAIToolCallDelta{d}}
+	}
+
+	chunks := []*OpenAIResponse{c.delta(choice, piece(OpenAIFunctionCallDelta{Name: call.Function.Name}, true))}
+
+	args := call.Function.Arguments
+	for len(args) > 0 {
+		end := min(argumentFragment, len(args))
+		for end < len(args) && !utf8.RuneStart(args[end]) {
+			end++
+		}
+		chunks = append(chunks, c.delta(choice, piece(OpenAIFunctionCallDelta{Arguments: args[:end]}, false)))
+		args = args[end:]
+	}
+	return chunks
+}
+
+// Finish returns the chunk that ends every choice with its finish reason. A stream
+// that produced no content still ends choice 0.
+func (c *StreamConverter) Finish() []*OpenAIResponse {
+	var chunks []*OpenAIResponse
+	order := c.order
+	if len(order) == 0 {
+		empty := ""
+		order = []int{0}
+		chunks = append(chunks, c.chunk([]OpenAIChoice{{Index: 0, Delta: &OpenAIDelta{Role: "assistant", Content: &empty}}}))
+	}
+
+	choices := make([]OpenAIChoice, 0, len(order))
+	for _, idx := range order {
+		fr := finishReason(c.finish[idx], c.calls[idx] > 0)
+		if fr == "tool_calls" && c.Calls.Legacy {
+			fr = "function_call"
+		}
+		choices = append(choices, OpenAIChoice{Index: idx, Delta: &OpenAIDelta{}, FinishReason: &fr})
+	}
+	return append(chunks, c.chunk(choices))
+}
+
+// Usage returns the final chunk reporting the whole response's usage, sent when the
+// client set stream_options.include_usage.
+func (c *StreamConverter) Usage(promptTokens, completionTokens int) *OpenAIResponse {
+	chunk := c.chunk([]OpenAIChoice{})
+	chunk.Usage = &OpenAIUsage{
+		PromptTokens:     promptTokens,
+		CompletionTokens: completionTokens,
+		TotalTokens:      promptTokens + completionTokens,
+	}
+	return chunk
+}
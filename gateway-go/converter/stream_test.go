@@ -0,0 +1,302 @@
+package converter
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+// Gemini streams as recorded from streamGenerateContent?alt=sse, one data frame each.
+var (
+	geminiTextStream = []string{
+		`{"candidates":[{"content":{"role":"model","parts":[{"text":"The quick "}]},"index":0}],"usageMetadata":{"promptTokenCount":9,"candidatesTokenCount":2,"totalTokenCount":11}}`,
+		`{"candidates":[{"content":{"role":"model","parts":[{"text":"brown fox"}]},"index":0}],"usageMetadata":{"promptTokenCount":9,"candidatesTokenCount":4,"totalTokenCount":13}}`,
+		`{"candidates":[{"content":{"role":"model","parts":[{"text":" jumps."}]},"finishReason":"STOP","index":0}],"usageMetadata":{"promptTokenCount":9,"candidatesTokenCount":6,"totalTokenCount":15}}`,
+	}
+	// The last frame has nothing but the finish reason, which Gemini sends at times
+	geminiBareFinishStream = []string{
+		`{"candidates":[{"content":{"role":"model","parts":[{"text":"Hello"}]},"index":0}]}`,
+		`{"candidates":[{"content":{"role":"model","parts":[]},"finishReason":"MAX_TOKENS","index":0}]}`,
+	}
+)
+
+// replay runs Gemini frames through a StreamConverter and returns the OpenAI chunks
+// as a client decodes them off the wire.
+func replay(t *testing.T, conv *StreamConverter, frames []string, includeUsage bool) []map[string]any {
+	t.Helper()
+	var chunks []*OpenAIResponse
+	for _, frame := range frames {
+		var gemResp GeminiResponse
+		if err := json.Unmarshal([]byte(frame), &gemResp); err != nil {
+			t.Fatal(err)
+		}
+		chunks = append(chunks, conv.Convert(&gemResp)...)
+	}
+	chunks = append(chunks, conv.Finish()...)
+	if includeUsage {
+		chunks = append(chunks, conv.Usage(9, 6))
+	}
+
+	wire := make([]map[string]any, len(chunks))
+	for i, chunk := range chunks {
+		data, err := json.Marshal(chunk)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := json.Unmarshal(data, &wire[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return wire
+}
+
+// choice returns a chunk's only choice, or nil when it has none.
+func choice(t *testing.T, chunk map[string]any) map[string]any {
+	t.Helper()
+	choices := chunk["choices"].([]any)
+	if len(choices) == 0 {
+		return nil
+	}
+	if len(choices) != 1 {
+		t.Fatalf("chunk has %d choices", len(choices))
+	}
+	return choices[0].(map[string]any)
+}
+
+func TestStreamConverterChunks(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		frames []string
+		text   string
+		finish string
+	}{
+		{"text", geminiTextStream, "The quick brown fox jumps.", "stop"},
+		{"bare finish frame", geminiBareFinishStream, "Hello", "length"},
+		{"empty", nil, "", "stop"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			conv := NewStreamConverter("gemini-2.0-flash", "chatcmpl-1", 1700000000)
+			chunks := replay(t, conv, tc.frames, true)
+
+			var text string
+			roles, finishes := 0, 0
+			for i, chunk := range chunks {
+				if chunk["id"] != "chatcmpl-1" || chunk["object"] != "chat.completion.chunk" ||
+					chunk["created"] != 1700000000.0 || chunk["system_fingerprint"] != SystemFingerprint("gemini-2.0-flash") {
+					t.Errorf("chunk %d header = %v", i, chunk)
+				}
+				c := choice(t, chunk)
+				if c == nil {
+					continue
+				}
+				delta := c["delta"].(map[string]any)
+				if role, ok := delta["role"]; ok {
+					roles++
+					if i != 0 || role != "assistant" {
+						t.Errorf("chunk %d has role %v", i, role)
+					}
+				}
+				if content, ok := delta["content"].(string); ok {
+					text += content
+				}
+				if fr := c["finish_reason"]; fr != nil {
+					finishes++
+					if fr != tc.finish || len(delta) != 0 {
+						t.Errorf("chunk %d: finish_reason %v with delta %v", i, fr, delta)
+					}
+					if i != len(chunks)-2 {
+						t.Errorf("finish_reason in chunk %d of %d", i, len(chunks))
+					}
+				}
+			}
+			if roles != 1 {
+				t.Errorf("role sent %d times", roles)
+			}
+			if finishes != 1 {
+				t.Errorf("finish_reason sent %d times", finishes)
+			}
+			if text != tc.text {
+				t.Errorf("text = %q, want %q", text, tc.text)
+			}
+
+			last := chunks[len(chunks)-1]
+			if choices, ok := last["choices"].([]any); !ok || len(choices) != 0 {
+				t.Errorf("usage chunk choices = %v, want []", last["choices"])
+			}
+			usage, _ := last["usage"].(map[string]any)
+			if usage["prompt_tokens"] != 9.0 || usage["completion_tokens"] != 6.0 || usage["total_tokens"] != 15.0 {
+				t.Errorf("usage = %v", usage)
+			}
+			for _, chunk := range chunks[:len(chunks)-1] {
+				if _, ok := chunk["usage"]; ok {
+					t.Errorf("usage on a content chunk: %v", chunk)
+				}
+			}
+		})
+	}
+}
+
+// A continuation is converted by the same StreamConverter; the first segment's finish
+// reason must not reach the client.
+func TestStreamConverterContinuation(t *testing.T) {
+	conv := NewStreamConverter("gemini-2.0-flash", "chatcmpl-1", 1700000000)
+	frames := append([]string{}, geminiBareFinishStream...)
+	frames = append(frames, geminiTextStream...)
+	chunks := replay(t, conv, frames, false)
+
+	finishes := 0
+	for _, chunk := range chunks {
+		if c := choice(t, chunk); c != nil && c["finish_reason"] != nil {
+			finishes++
+			if c["finish_reason"] != "stop" {
+				t.Errorf("finish_reason = %v, want stop", c["finish_reason"])
+			}
+		}
+	}
+	if finishes != 1 {
+		t.Errorf("finish_reason sent %d times", finishes)
+	}
+}
+
+// geminiToolStream makes three calls over two frames, with text between them, and
+// arguments long enough to be split into several fragments.
+var geminiToolStream = []string{
+	`{"candidates":[{"content":{"role":"model","parts":[{"text":"Checking both cities."}]},"index":0}]}`,
+	`{"candidates":[{"content":{"role":"model","parts":[` +
+		`{"functionCall":{"name":"get_weather","args":{"city":"Paris","units":"celsius","days":["mon","tue","wed"]}}},` +
+		`{"functionCall":{"name":"get_weather","args":{"city":"Rome","units":"celsius","note":"héllo wörld, ünïcode spans fragment boundaries"}}}]},"index":0}]}`,
+	`{"candidates":[{"content":{"role":"model","parts":[{"text":"Also the time."},{"functionCall":{"name":"get_time"}}]},"finishReason":"STOP","index":0}]}`,
+}
+
+// accumulatedCall is a tool call as the OpenAI SDKs rebuild it from deltas.
+type accumulatedCall struct {
+	id, typ, name, args string
+	fragments           int
+}
+
+// accumulate rebuilds tool calls the way the OpenAI SDKs do: by index, taking the
+// ID, type and name from the first delta and concatenating every delta's arguments.
+func accumulate(t *testing.T, chunks []map[string]any) (map[float64]*accumulatedCall, []any) {
+	t.Helper()
+	calls := make(map[float64]*accumulatedCall)
+	var finishes []any
+	for i, chunk := range chunks {
+		c := choice(t, chunk)
+		if c == nil {
+			continue
+		}
+		if fr := c["finish_reason"]; fr != nil {
+			finishes = append(finishes, fr)
+		}
+		deltas, _ := c["delta"].(map[string]any)["tool_calls"].([]any)
+		for _, d := range deltas {
+			delta := d.(map[string]any)
+			index, ok := delta["index"].(float64)
+			if !ok {
+				t.Fatalf("chunk %d: tool call delta without index: %v", i, delta)
+			}
+			fn := delta["function"].(map[string]any)
+			call := calls[index]
+			if call == nil {
+				call = &accumulatedCall{}
+				calls[index] = call
+				call.id, _ = delta["id"].(string)
+				call.typ, _ = delta["type"].(string)
+				call.name, _ = fn["name"].(string)
+			} else if delta["id"] != nil || delta["type"] != nil || fn["name"] != nil {
+				t.Errorf("chunk %d: call %v repeats its id, type or name: %v", i, index, delta)
+			}
+			args, _ := fn["arguments"].(string)
+			call.args += args
+			call.fragments++
+		}
+	}
+	return calls, finishes
+}
+
+// interleave reorders the tool call deltas of parallel calls so that fragments of
+// different calls alternate, as OpenAI may stream them, keeping each call's own
+// fragments in order.
+func interleave(t *testing.T, chunks []map[string]any) []map[string]any {
+	t.Helper()
+	var rest []map[string]any
+	var queues [][]map[string]any
+	for _, chunk := range chunks {
+		c := choice(t, chunk)
+		deltas, _ := c["delta"].(map[string]any)["tool_calls"].([]any)
+		if len(deltas) == 0 {
+			rest = append(rest, chunk)
+			continue
+		}
+		index := int(deltas[0].(map[string]any)["index"].(float64))
+		for len(queues) <= index {
+			queues = append(queues, nil)
+		}
+		queues[index] = append(queues[index], chunk)
+	}
+	var out []map[string]any
+	for more := true; more; {
+		more = false
+		for i, q := range queues {
+			if len(q) > 0 {
+				out = append(out, q[0])
+				queues[i] = q[1:]
+				more = true
+			}
+		}
+	}
+	// Text and the finish reason stay around the calls
+	return append(append(rest[:len(rest)-1:len(rest)-1], out...), rest[len(rest)-1])
+}
+
+func TestStreamConverterToolCalls(t *testing.T) {
+	conv := NewStreamConverter("gemini-2.0-flash", "chatcmpl-1", 1700000000)
+	chunks := replay(t, conv, geminiToolStream, false)
+	t.Run("in order", func(t *testing.T) { checkToolCalls(t, chunks) })
+	t.Run("interleaved", func(t *testing.T) { checkToolCalls(t, interleave(t, chunks)) })
+}
+
+func checkToolCalls(t *testing.T, chunks []map[string]any) {
+	calls, finishes := accumulate(t, chunks)
+
+	want := []struct {
+		name string
+		args map[string]any
+	}{
+		{"get_weather", map[string]any{"city": "Paris", "units": "celsius", "days": []any{"mon", "tue", "wed"}}},
+		{"get_weather", map[string]any{"city": "Rome", "units": "celsius", "note": "héllo wörld, ünïcode spans fragment boundaries"}},
+		{"get_time", map[string]any{}},
+	}
+	if len(calls) != len(want) {
+		t.Fatalf("rebuilt %d calls, want %d", len(calls), len(want))
+	}
+	ids := make(map[string]bool)
+	for i, w := range want {
+		call := calls[float64(i)]
+		if call == nil {
+			t.Fatalf("no call with index %d", i)
+		}
+		if call.id == "" || ids[call.id] {
+			t.Errorf("call %d: id %q missing or repeated", i, call.id)
+		}
+		ids[call.id] = true
+		if call.typ != "function" || call.name != w.name {
+			t.Errorf("call %d: type %q name %q", i, call.typ, call.name)
+		}
+		var args map[string]any
+		if err := json.Unmarshal([]byte(call.args), &args); err != nil {
+			t.Errorf("call %d: arguments %q: %v", i, call.args, err)
+			continue
+		}
+		got, _ := json.Marshal(args)
+		expected, _ := json.Marshal(w.args)
+		if string(got) != string(expected) {
+			t.Errorf("call %d: arguments %s, want %s", i, got, expected)
+		}
+	}
+	if calls[0].fragments < 3 || calls[1].fragments < 3 {
+		t.Errorf("arguments not fragmented: %d and %d deltas", calls[0].fragments, calls[1].fragments)
+	}
+	if len(finishes) != 1 || finishes[0] != "tool_calls" {
+		t.Errorf("finish reasons = %v, want [tool_calls]", finishes)
+	}
+}
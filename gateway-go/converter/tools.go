@@ -0,0 +1,170 @@
+package converter
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+)
+
+// ToolCallID derives the ID of the n-th tool call of a choice in response reqID.
+// Gemini doesn't identify function calls, so IDs are made unique per call and
+// deterministic, so the same response always carries the same IDs.
+func ToolCallID(reqID string, choice, n int) string {
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%s/%d/%d", reqID, choice, n)))
+	return "call_" + hex.EncodeToString(sum[:12])
+}
+
+// toolCall converts the n-th function call of a choice.
+func toolCall(reqID string, choice, n int, fc *GeminiFunctionCall) OpenAIToolCall {
+	argsJSON := []byte("{}") // a call without arguments
+	if fc.Args != nil {
+		argsJSON, _ = json.Marshal(fc.Args)
+	}
+	return OpenAIToolCall{
+		ID:   ToolCallID(reqID, choice, n),
+		Type: "function",
+		Function: OpenAIFunctionCall{
+			Name:      fc.Name,
+			Arguments: string(argsJSON),
+		},
+	}
+}
+
+// toolNames maps the tool call IDs in a conversation's assistant messages to the
+// functions they called, since tool results usually carry only the ID while Gemini
+// matches function responses by name.
+func toolNames(messages []OpenAIMessage) map[string]string {
+	names := make(map[string]string)
+	for _, msg := range messages {
+		if msg.Role != "assistant" {
+			continue
+		}
+		for _, tc := range msg.ToolCalls {
+			names[tc.ID] = tc.Function.Name
+		}
+	}
+	return names
+}
+
+// convertTools translates tools and tool_choice, or the legacy functions and
+// function_call fields, into Gemini function declarations and calling config.
+func convertTools(req *OpenAIRequest) ([]GeminiToolDef, *GeminiToolConfig, error) {
+	funcs, choice, field := req.Functions, req.FunctionCall, "function_call"
+	legacy := len(req.Functions) > 0 || req.FunctionCall != nil
+	if legacy && (len(req.Tools) > 0 || req.ToolChoice != nil) {
+		return nil, nil, fmt.Errorf("functions and function_call cannot be combined with tools and tool_choice")
+	}
+	if !legacy {
+		funcs, choice, field = nil, req.ToolChoice, "tool_choice"
+		for i, tool := range req.Tools {
+			if tool.Type != "function" {
+				return nil, nil, fmt.Errorf("tools[%d]: unsupported tool type %q", i, tool.Type)
+			}
+			funcs = append(funcs, tool.Function)
+		}
+	}
+
+	var tools []GeminiToolDef
+	if len(funcs) > 0 {
+		var decls []GeminiFuncDecl
+		for _, fn := range funcs {
+			decls = append(decls, GeminiFuncDecl{
+				Name:        fn.Name,
+				Description: fn.Description,
+				Parameters:  CleanSchemaForGemini(fn.Parameters),
+			})
+		}
+		tools = []GeminiToolDef{{FunctionDeclarations: decls}}
+	}
+	if choice == nil {
+		return tools, nil, nil
+	}
+
+	cfg := &FunctionCallingConfig{}
+	switch v := choice.(type) {
+	case string:
+		switch v {
+		case "auto":
+			cfg.Mode = "AUTO"
+		case "none":
+			cfg.Mode = "NONE"
+		case "required":
+			cfg.Mode = "ANY"
+		default:
+			return nil, nil, fmt.Errorf("%s: unsupported value %q", field, v)
+		}
+	case map[string]any:
+		// {"type": "function", "function": {"name": "x"}}, or {"name": "x"} in the legacy form
+		fn := v
+		if !legacy {
+			fn, _ = v["function"].(map[string]any)
+			if v["type"] != "function" || fn == nil {
+				return nil, nil, fmt.Errorf(`%s: object must be {"type": "function", "function": {"name": ...}}`, field)
+			}
+		}
+		name, _ := fn["name"].(string)
+		if name == "" {
+			return nil, nil, fmt.Errorf("%s: function name required", field)
+		}
+		if !offers(funcs, name) {
+			return nil, nil, fmt.Errorf("%s: function %q is not among the functions offered", field, name)
+		}
+		cfg.Mode = "ANY"
+		cfg.AllowedFunctionNames = []string{name}
+	default:
+		return nil, nil, fmt.Errorf("%s: must be a string or an object", field)
+	}
+	if cfg.Mode == "ANY" && len(funcs) == 0 {
+		return nil, nil, fmt.Errorf("%s: requiring a function call needs functions to call", field)
+	}
+	return tools, &GeminiToolConfig{FunctionCallingConfig: cfg}, nil
+}
+
+func offers(funcs []OpenAIFunction, name string) bool {
+	for _, fn := range funcs {
+		if fn.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// CallStyle is how a request wants function calls returned.
+type CallStyle struct {
+	Single bool // only the first call of a turn is kept; Gemini can't be told not to make several
+	Legacy bool // returned as function_call rather than tool_calls
+}
+
+// CallStyleFor returns the style a request asks for: single calls when it sets
+// parallel_tool_calls to false, legacy single calls when it offers functions.
+func CallStyleFor(req *OpenAIRequest) CallStyle {
+	legacy := len(req.Functions) > 0
+	return CallStyle{
+		Single: legacy || req.ParallelToolCalls != nil && !*req.ParallelToolCalls,
+		Legacy: legacy,
+	}
+}
+
+// Apply reshapes the tool calls of a non-streamed response to the style.
+func (s CallStyle) Apply(resp *OpenAIResponse) {
+	for i := range resp.Choices {
+		choice := &resp.Choices[i]
+		msg := choice.Message
+		if msg == nil || len(msg.ToolCalls) == 0 {
+			continue
+		}
+		if s.Single {
+			msg.ToolCalls = msg.ToolCalls[:1]
+		}
+		if s.Legacy {
+			fc := msg.ToolCalls[0].Function
+			msg.FunctionCall = &fc
+			msg.ToolCalls = nil
+			if choice.FinishReason != nil && *choice.FinishReason == "tool_calls" {
+				fr := "function_call"
+				choice.FinishReason = &fr
+			}
+		}
+	}
+}
@@ -0,0 +1,56 @@
+package converter
+
+import (
+	"fmt"
+)
+
+// MergeTurns joins adjacent contents of the same role into one content with all their
+// parts, since Gemini requires user and model turns to alternate. Several tool results
+// in a row, or tool results followed by a user message, become one user turn.
+func MergeTurns(contents []GeminiContent) []GeminiContent {
+	merged := make([]GeminiContent, 0, len(contents))
+	for _, c := range contents {
+		if n := len(merged); n > 0 && merged[n-1].Role == c.Role {
+			parts := make([]GeminiPart, 0, len(merged[n-1].Parts)+len(c.Parts))
+			parts = append(parts, merged[n-1].Parts...)
+			merged[n-1].Parts = append(parts, c.Parts...)
+			continue
+		}
+		merged = append(merged, c)
+	}
+	return merged
+}
+
+// validateTurns checks a merged conversation the way Gemini will: it opens with a
+// user turn, and every turn of function calls is answered by the next turn with a
+// response for each call.
+func validateTurns(contents []GeminiContent) error {
+	if len(contents) == 0 {
+		return fmt.Errorf("messages must include at least one user, assistant or tool message")
+	}
+	if contents[0].Role != "user" {
+		return fmt.Errorf("conversation must start with a user message, not an assistant message")
+	}
+
+	for i, c := range contents {
+		calls := 0
+		for _, p := range c.Parts {
+			if p.FunctionCall != nil {
+				calls++
+			}
+		}
+		if calls == 0 || i == len(contents)-1 {
+			continue
+		}
+		responses := 0
+		for _, p := range contents[i+1].Parts {
+			if p.FunctionResp != nil {
+				responses++
+			}
+		}
+		if responses != calls {
+			return fmt.Errorf("an assistant message made %d tool calls but %d tool results follow it", calls, responses)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,157 @@
+package converter
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+// turnsTests are transcripts as OpenAI clients send them, with the Gemini turns each
+// should become: one entry per turn, the role followed by a letter per part (t text,
+// c function call, r function response).
+var turnsTests = []struct {
+	name     string
+	messages string
+	system   string
+	turns    []string
+	err      string // substring of the expected error
+}{
+	{
+		name: "system and developer messages",
+		messages: `[
+			{"role": "system", "content": "You are terse."},
+			{"role": "developer", "content": "Answer in French."},
+			{"role": "user", "content": "Hello"},
+			{"role": "system", "content": [{"type": "text", "text": "Never apologise."}]}
+		]`,
+		system: "You are terse.\n\nAnswer in French.\n\nNever apologise.",
+		turns:  []string{"user t"},
+	},
+	{
+		name: "adjacent user messages",
+		messages: `[
+			{"role": "user", "content": "Here is a poem."},
+			{"role": "user", "content": [{"type": "text", "text": "Roses are red"}, {"type": "text", "text": "Violets are blue"}]},
+			{"role": "assistant", "content": "Lovely."},
+			{"role": "user", "content": "Another?"}
+		]`,
+		turns: []string{"user ttt", "model t", "user t"},
+	},
+	{
+		name: "parallel tool results then a user message",
+		messages: `[
+			{"role": "user", "content": "Weather in Paris and Rome?"},
+			{"role": "assistant", "content": null, "tool_calls": [
+				{"id": "call_1", "type": "function", "function": {"name": "get_weather", "arguments": "{\"city\":\"Paris\"}"}},
+				{"id": "call_2", "type": "function", "function": {"name": "get_weather", "arguments": "{\"city\":\"Rome\"}"}}
+			]},
+			{"role": "tool", "tool_call_id": "call_1", "content": "{\"temp\":18}"},
+			{"role": "tool", "tool_call_id": "call_2", "content": "sunny"},
+			{"role": "user", "content": "And in Celsius?"}
+		]`,
+		turns: []string{"user t", "model cc", "user rrt"},
+	},
+	{
+		name: "assistant speaks first",
+		messages: `[
+			{"role": "system", "content": "Greet the user."},
+			{"role": "assistant", "content": "Hi! How can I help?"},
+			{"role": "user", "content": "Tell me a joke."}
+		]`,
+		err: "must start with a user message",
+	},
+	{
+		name: "tool result missing",
+		messages: `[
+			{"role": "user", "content": "Weather in Paris and Rome?"},
+			{"role": "assistant", "tool_calls": [
+				{"id": "call_1", "type": "function", "function": {"name": "get_weather", "arguments": "{}"}},
+				{"id": "call_2", "type": "function", "function": {"name": "get_weather", "arguments": "{}"}}
+			]},
+			{"role": "tool", "tool_call_id": "call_1", "content": "18"},
+			{"role": "user", "content": "Well?"}
+		]`,
+		err: "made 2 tool calls but 1 tool results follow it",
+	},
+	{
+		name: "unknown role",
+		messages: `[
+			{"role": "user", "content": "Hello"},
+			{"role": "critic", "content": "Be nicer."}
+		]`,
+		err: `messages[1]: unknown role "critic"`,
+	},
+	{
+		name:     "no conversation",
+		messages: `[{"role": "system", "content": "You are terse."}]`,
+		err:      "at least one",
+	},
+}
+
+func TestOpenAIToGeminiTurns(t *testing.T) {
+	for _, tc := range turnsTests {
+		t.Run(tc.name, func(t *testing.T) {
+			req := &OpenAIRequest{Model: "gemini-2.0-flash"}
+			if err := json.Unmarshal([]byte(tc.messages), &req.Messages); err != nil {
+				t.Fatal(err)
+			}
+			gemReq, err := OpenAIToGemini(context.Background(), req, nil)
+			if tc.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.err) {
+					t.Fatalf("error = %v, want one containing %q", err, tc.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			system := ""
+			if gemReq.SystemInstruction != nil {
+				system = gemReq.SystemInstruction.Parts[0].Text
+			}
+			if system != tc.system {
+				t.Errorf("system instruction = %q, want %q", system, tc.system)
+			}
+			if got := turnShapes(gemReq.Contents); strings.Join(got, ", ") != strings.Join(tc.turns, ", ") {
+				t.Errorf("turns = %v, want %v", got, tc.turns)
+			}
+		})
+	}
+}
+
+func turnShapes(contents []GeminiContent) []string {
+	var shapes []string
+	for _, c := range contents {
+		var b strings.Builder
+		b.WriteString(c.Role + " ")
+		for _, p := range c.Parts {
+			switch {
+			case p.FunctionCall != nil:
+				b.WriteByte('c')
+			case p.FunctionResp != nil:
+				b.WriteByte('r')
+			default:
+				b.WriteByte('t')
+			}
+		}
+		shapes = append(shapes, b.String())
+	}
+	return shapes
+}
+
+func TestMergeTurnsKeepsInputIntact(t *testing.T) {
+	contents := []GeminiContent{
+		{Role: "user", Parts: []GeminiPart{{Text: "a"}}},
+		{Role: "user", Parts: []GeminiPart{{Text: "b"}}},
+		{Role: "model", Parts: []GeminiPart{{Text: "c"}}},
+	}
+	merged := MergeTurns(contents)
+	if len(merged) != 2 || len(merged[0].Parts) != 2 {
+		t.Fatalf("merged = %+v", merged)
+	}
+	if len(contents[0].Parts) != 1 {
+		t.Errorf("MergeTurns modified its input: %+v", contents[0])
+	}
+}
@@ -0,0 +1,241 @@
+package converter
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"reflect"
+	"regexp"
+	"unicode/utf8"
+)
+
+// ValidateJSON checks that data is a single JSON value and, if schema is not nil,
+// that it matches schema. It understands the keywords structured outputs use: type,
+// enum, const, properties, required, additionalProperties, items, anyOf, oneOf,
+// allOf, local $refs, and the usual string, number and array bounds. Others, such
+// as format, are ignored.
+func ValidateJSON(data []byte, schema map[string]any) error {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	var v any
+	if err := dec.Decode(&v); err != nil {
+		return fmt.Errorf("not valid JSON: %w", err)
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return fmt.Errorf("not valid JSON: data after the top-level value")
+	}
+	if schema == nil {
+		return nil
+	}
+	return validateValue(v, schema, schema, "$", 0)
+}
+
+func validateValue(v any, s, root map[string]any, path string, depth int) error {
+	if ref, ok := s["$ref"].(string); ok {
+		target := resolveRef(root, ref)
+		if target == nil {
+			return fmt.Errorf("%s: unresolvable $ref %q", path, ref)
+		}
+		if depth >= 64 {
+			return fmt.Errorf("%s: $ref nesting too deep", path)
+		}
+		if err := validateValue(v, target, root, path, depth+1); err != nil {
+			return err
+		}
+	}
+
+	if types, ok := s["type"]; ok && !matchesType(v, types) {
+		return fmt.Errorf("%s: expected %v, got %s", path, types, jsonType(v))
+	}
+	if enum, ok := s["enum"].([]any); ok {
+		found := false
+		for _, e := range enum {
+			if reflect.DeepEqual(v, e) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("%s: value not in enum %v", path, enum)
+		}
+	}
+	if c, ok := s["const"]; ok && !reflect.DeepEqual(v, c) {
+		return fmt.Errorf("%s: value must be %v", path, c)
+	}
+
+	for _, sub := range schemaList(s["allOf"]) {
+		if err := validateValue(v, sub, root, path, depth); err != nil {
+			return err
+		}
+	}
+	if subs := schemaList(s["anyOf"]); len(subs) > 0 {
+		var firstErr error
+		for _, sub := range subs {
+			err := validateValue(v, sub, root, path, depth)
+			if err == nil {
+				firstErr = nil
+				break
+			}
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+		if firstErr != nil {
+			return fmt.Errorf("%s: matches none of anyOf (first: %v)", path, firstErr)
+		}
+	}
+	if subs := schemaList(s["oneOf"]); len(subs) > 0 {
+		matched := 0
+		for _, sub := range subs {
+			if validateValue(v, sub, root, path, depth) == nil {
+				matched++
+			}
+		}
+		if matched != 1 {
+			return fmt.Errorf("%s: matches %d of oneOf, want exactly 1", path, matched)
+		}
+	}
+
+	switch val := v.(type) {
+	case map[string]any:
+		return validateObject(val, s, root, path, depth)
+	case []any:
+		if n, ok := number(s["minItems"]); ok && float64(len(val)) < n {
+			return fmt.Errorf("%s: fewer than %v items", path, n)
+		}
+		if n, ok := number(s["maxItems"]); ok && float64(len(val)) > n {
+			return fmt.Errorf("%s: more than %v items", path, n)
+		}
+		if items, ok := s["items"].(map[string]any); ok {
+			for i, item := range val {
+				if err := validateValue(item, items, root, fmt.Sprintf("%s[%d]", path, i), depth); err != nil {
+					return err
+				}
+			}
+		}
+	case string:
+		n := float64(utf8.RuneCountInString(val))
+		if min, ok := number(s["minLength"]); ok && n < min {
+			return fmt.Errorf("%s: shorter than %v characters", path, min)
+		}
+		if max, ok := number(s["maxLength"]); ok && n > max {
+			return fmt.Errorf("%s: longer than %v characters", path, max)
+		}
+		if pattern, ok := s["pattern"].(string); ok {
+			re, err := regexp.Compile(pattern)
+			if err == nil && !re.MatchString(val) {
+				return fmt.Errorf("%s: does not match pattern %q", path, pattern)
+			}
+		}
+	case float64:
+		if min, ok := number(s["minimum"]); ok && val < min {
+			return fmt.Errorf("%s: less than minimum %v", path, min)
+		}
+		if max, ok := number(s["maximum"]); ok && val > max {
+			return fmt.Errorf("%s: greater than maximum %v", path, max)
+		}
+		if min, ok := number(s["exclusiveMinimum"]); ok && val <= min {
+			return fmt.Errorf("%s: not greater than %v", path, min)
+		}
+		if max, ok := number(s["exclusiveMaximum"]); ok && val >= max {
+			return fmt.Errorf("%s: not less than %v", path, max)
+		}
+	}
+	return nil
+}
+
+func validateObject(obj, s, root map[string]any, path string, depth int) error {
+	props, _ := s["properties"].(map[string]any)
+	if required, ok := s["required"].([]any); ok {
+		for _, r := range required {
+			if name, ok := r.(string); ok {
+				if _, present := obj[name]; !present {
+					return fmt.Errorf("%s: missing required property %q", path, name)
+				}
+			}
+		}
+	}
+	for name, value := range obj {
+		child := path + "." + name
+		if ps, ok := props[name].(map[string]any); ok {
+			if err := validateValue(value, ps, root, child, depth); err != nil {
+				return err
+			}
+			continue
+		}
+		switch extra := s["additionalProperties"].(type) {
+		case bool:
+			if !extra {
+				return fmt.Errorf("%s: unexpected property", child)
+			}
+		case map[string]any:
+			if err := validateValue(value, extra, root, child, depth); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func matchesType(v any, types any) bool {
+	switch t := types.(type) {
+	case string:
+		return isType(v, t)
+	case []any:
+		for _, item := range t {
+			if name, ok := item.(string); ok && isType(v, name) {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+func isType(v any, name string) bool {
+	switch name {
+	case "integer":
+		f, ok := v.(float64)
+		return ok && f == math.Trunc(f)
+	case "number":
+		_, ok := v.(float64)
+		return ok
+	default:
+		return jsonType(v) == name
+	}
+}
+
+func jsonType(v any) string {
+	switch v.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case float64:
+		return "number"
+	case string:
+		return "string"
+	case []any:
+		return "array"
+	case map[string]any:
+		return "object"
+	}
+	return fmt.Sprintf("%T", v)
+}
+
+func schemaList(v any) []map[string]any {
+	arr, _ := v.([]any)
+	var out []map[string]any
+	for _, item := range arr {
+		if m, ok := item.(map[string]any); ok {
+			out = append(out, m)
+		}
+	}
+	return out
+}
+
+func number(v any) (float64, bool) {
+	f, ok := v.(float64)
+	return f, ok
+}
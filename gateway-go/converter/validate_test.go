@@ -0,0 +1,99 @@
+package converter
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+// personSchema is a strict structured-outputs schema with nested objects, arrays,
+// an enum and a $ref.
+const personSchema = `{
+	"type": "object",
+	"properties": {
+		"name": {"type": "string", "minLength": 1},
+		"age": {"type": "integer", "minimum": 0},
+		"role": {"type": "string", "enum": ["admin", "user"]},
+		"email": {"type": ["string", "null"]},
+		"address": {"$ref": "#/$defs/address"},
+		"tags": {"type": "array", "items": {"type": "string"}, "maxItems": 3}
+	},
+	"required": ["name", "age", "role"],
+	"additionalProperties": false,
+	"$defs": {
+		"address": {
+			"type": "object",
+			"properties": {"city": {"type": "string"}, "zip": {"type": "string", "pattern": "^[0-9]{5}$"}},
+			"required": ["city"],
+			"additionalProperties": false
+		}
+	}
+}`
+
+func decodeSchema(t *testing.T, s string) map[string]any {
+	t.Helper()
+	var schema map[string]any
+	if err := json.Unmarshal([]byte(s), &schema); err != nil {
+		t.Fatal(err)
+	}
+	return schema
+}
+
+func TestValidateJSON(t *testing.T) {
+	person := decodeSchema(t, personSchema)
+	for _, tc := range []struct {
+		name   string
+		data   string
+		schema map[string]any
+		err    string // substring of the expected error; empty for valid
+	}{
+		{"any JSON", `{"a": [1, 2]}`, nil, ""},
+		{"not JSON", `{"a": `, nil, "not valid JSON"},
+		{"two values", `{} {}`, nil, "data after the top-level value"},
+		{"plain text", `Sure! Here is the JSON`, nil, "not valid JSON"},
+
+		{"valid", `{"name": "Ada", "age": 36, "role": "admin"}`, person, ""},
+		{"valid nested", `{"name": "Ada", "age": 36, "role": "user", "email": null,
+			"address": {"city": "London", "zip": "12345"}, "tags": ["a", "b"]}`, person, ""},
+		{"wrong top-level type", `[]`, person, "$: expected object, got array"},
+		{"missing required", `{"name": "Ada", "role": "admin"}`, person, `missing required property "age"`},
+		{"integer with fraction", `{"name": "Ada", "age": 36.5, "role": "admin"}`, person, "$.age: expected integer"},
+		{"string for integer", `{"name": "Ada", "age": "36", "role": "admin"}`, person, "$.age: expected integer, got string"},
+		{"below minimum", `{"name": "Ada", "age": -1, "role": "admin"}`, person, "$.age: less than minimum"},
+		{"not in enum", `{"name": "Ada", "age": 36, "role": "root"}`, person, "$.role: value not in enum"},
+		{"type union", `{"name": "Ada", "age": 36, "role": "user", "email": 5}`, person, "$.email: expected"},
+		{"too short", `{"name": "", "age": 36, "role": "user"}`, person, "$.name: shorter than"},
+		{"extra property", `{"name": "Ada", "age": 36, "role": "user", "nick": "A"}`, person, "$.nick: unexpected property"},
+		{"ref missing required", `{"name": "Ada", "age": 36, "role": "user", "address": {}}`, person, `$.address: missing required property "city"`},
+		{"ref extra property", `{"name": "Ada", "age": 36, "role": "user", "address": {"city": "x", "planet": "Earth"}}`, person, "$.address.planet: unexpected property"},
+		{"ref pattern", `{"name": "Ada", "age": 36, "role": "user", "address": {"city": "x", "zip": "ABCDE"}}`, person, "$.address.zip: does not match pattern"},
+		{"array item type", `{"name": "Ada", "age": 36, "role": "user", "tags": ["a", 2]}`, person, "$.tags[1]: expected string"},
+		{"too many items", `{"name": "Ada", "age": 36, "role": "user", "tags": ["a", "b", "c", "d"]}`, person, "$.tags: more than 3 items"},
+
+		{"unresolvable ref", `{}`, map[string]any{"$ref": "#/$defs/nope"}, "unresolvable $ref"},
+		{"recursive ref", `{"next": {"next": {}}}`, decodeSchema(t, `{
+			"$ref": "#/$defs/node",
+			"$defs": {"node": {"type": "object", "properties": {"next": {"$ref": "#/$defs/node"}}}}
+		}`), ""},
+		{"anyOf", `3`, decodeSchema(t, `{"anyOf": [{"type": "string"}, {"type": "integer"}]}`), ""},
+		{"anyOf none", `true`, decodeSchema(t, `{"anyOf": [{"type": "string"}, {"type": "integer"}]}`), "matches none of anyOf"},
+		{"oneOf both", `3`, decodeSchema(t, `{"oneOf": [{"type": "number"}, {"type": "integer"}]}`), "matches 2 of oneOf"},
+		{"allOf", `{"a": 1}`, decodeSchema(t, `{"allOf": [{"required": ["a"]}, {"required": ["b"]}]}`), `missing required property "b"`},
+		{"const", `"x"`, decodeSchema(t, `{"const": "y"}`), "value must be y"},
+		{"additionalProperties schema", `{"a": 1, "b": "x"}`, decodeSchema(t, `{"properties": {"a": {}}, "additionalProperties": {"type": "integer"}}`), "$.b: expected integer"},
+		{"format ignored", `"not an email"`, decodeSchema(t, `{"type": "string", "format": "email"}`), ""},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			err := ValidateJSON([]byte(tc.data), tc.schema)
+			if tc.err == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tc.err) {
+				t.Fatalf("error = %v, want one containing %q", err, tc.err)
+			}
+		})
+	}
+}
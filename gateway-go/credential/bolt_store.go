@@ -0,0 +1,83 @@
+package credential
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var credentialsBucket = []byte("credentials")
+
+// BoltStore keeps credentials in an embedded bbolt database, one JSON value per ID.
+// Every Save is a single fsynced transaction.
+type BoltStore struct {
+	db *bolt.DB
+}
+
+func NewBoltStore(path string) (*BoltStore, error) {
+	db, err := bolt.Open(path, 0o600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("open credential db: %w", err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(credentialsBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &BoltStore{db: db}, nil
+}
+
+func (s *BoltStore) Load() ([]*Credential, error) {
+	var creds []*Credential
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(credentialsBucket).ForEach(func(k, v []byte) error {
+			var c Credential
+			if err := json.Unmarshal(v, &c); err != nil {
+				return fmt.Errorf("parse %s: %w", k, err)
+			}
+			if c.ID == "" {
+				c.ID = string(k)
+			}
+			if c.ID != string(k) || !ValidID(c.ID) {
+				return fmt.Errorf("record %s: holds credential id %q", k, c.ID)
+			}
+			creds = append(creds, &c)
+			return nil
+		})
+	})
+	return creds, err
+}
+
+func (s *BoltStore) Save(creds ...*Credential) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(credentialsBucket)
+		for _, c := range creds {
+			if !ValidID(c.ID) {
+				return fmt.Errorf("invalid credential id %q", c.ID)
+			}
+			data, err := json.Marshal(c)
+			if err != nil {
+				return err
+			}
+			if err := b.Put([]byte(c.ID), data); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *BoltStore) Delete(id string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(credentialsBucket).Delete([]byte(id))
+	})
+}
+
+func (s *BoltStore) Close() error {
+	return s.db.Close()
+}
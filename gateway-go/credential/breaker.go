@@ -0,0 +1,287 @@
+package credential
+
+import (
+	"fmt"
+	"time"
+)
+
+// Breaker defaults, used when the matching BreakerConfig field is zero.
+const (
+	defaultFailureThreshold = 3
+	defaultOpenDuration     = 30 * time.Second
+	defaultMaxOpenDuration  = 10 * time.Minute
+	defaultProbeTimeout     = 2 * time.Minute
+	defaultDisableAfter     = 5
+)
+
+// BreakerConfig tunes the per credential×model circuit breakers.
+type BreakerConfig struct {
+	// FailureThreshold is how many consecutive credential-caused failures open the breaker.
+	// Rate limits open it immediately.
+	FailureThreshold int
+	// OpenDuration is the first open period when the upstream gave no cooldown. Each
+	// reopening without an intervening success doubles it, up to MaxOpenDuration.
+	OpenDuration    time.Duration
+	MaxOpenDuration time.Duration
+	// ProbeTimeout frees a half-open breaker whose probe never reported back.
+	ProbeTimeout time.Duration
+	// DisableAfter consecutive authentication failures disable the credential for good.
+	DisableAfter int
+}
+
+func (c *BreakerConfig) setDefaults() {
+	if c.FailureThreshold <= 0 {
+		c.FailureThreshold = defaultFailureThreshold
+	}
+	if c.OpenDuration <= 0 {
+		c.OpenDuration = defaultOpenDuration
+	}
+	if c.MaxOpenDuration < c.OpenDuration {
+		c.MaxOpenDuration = defaultMaxOpenDuration
+		if c.MaxOpenDuration < c.OpenDuration {
+			c.MaxOpenDuration = c.OpenDuration
+		}
+	}
+	if c.ProbeTimeout <= 0 {
+		c.ProbeTimeout = defaultProbeTimeout
+	}
+	if c.DisableAfter <= 0 {
+		c.DisableAfter = defaultDisableAfter
+	}
+}
+
+type BreakerState string
+
+const (
+	BreakerClosed   BreakerState = "closed"
+	BreakerOpen     BreakerState = "open"
+	BreakerHalfOpen BreakerState = "half_open"
+)
+
+// Failure describes an upstream error reported through RecordError.
+type Failure struct {
+	StatusCode int    // HTTP status; 0 for transport errors
+	Status     string // Gemini error.status, e.g. "INVALID_ARGUMENT"; may be empty
+	Reason     string // Gemini ErrorInfo reason, e.g. "API_KEY_INVALID"; may be empty
+	// Cooldown is the wait the upstream asked for; zero if it gave none.
+	Cooldown time.Duration
+}
+
+type failureClass int
+
+const (
+	// classRequest errors are caused by the request itself; the credential is healthy.
+	classRequest failureClass = iota
+	classRateLimit
+	classAuth
+	classUpstream
+)
+
+func (f Failure) class() failureClass {
+	switch {
+	case f.StatusCode == 429 || f.Status == "RESOURCE_EXHAUSTED":
+		return classRateLimit
+	case f.StatusCode == 401 || f.StatusCode == 403 ||
+		f.Status == "UNAUTHENTICATED" || f.Status == "PERMISSION_DENIED":
+		return classAuth
+	case f.Reason == "API_KEY_INVALID" || f.Reason == "ACCESS_TOKEN_EXPIRED" || f.Reason == "ACCESS_TOKEN_INVALID":
+		return classAuth
+	case f.StatusCode == 0 || f.StatusCode == 408 || f.StatusCode >= 500:
+		return classUpstream
+	default:
+		return classRequest
+	}
+}
+
+// CredentialCaused reports whether f reflects on the credential (and so another
+// credential may succeed) rather than on the request.
+func (f Failure) CredentialCaused() bool {
+	return f.class() != classRequest
+}
+
+// breaker is the state machine for one credential×model. The open period itself lives
+// in Credential.ModelCooldowns so it is persisted and visible to the admin API.
+type breaker struct {
+	state    BreakerState
+	failures int       // consecutive credential-caused failures while closed
+	opens    int       // consecutive openings without a success; drives backoff
+	probeAt  time.Time // when the half-open probe was handed out
+}
+
+// BreakerInfo is the admin view of one breaker.
+type BreakerInfo struct {
+	State     BreakerState `json:"state"`
+	Failures  int          `json:"failures"`
+	OpenUntil *time.Time   `json:"open_until,omitempty"`
+}
+
+// breakerFor returns the breaker for model, creating a closed one. Caller must hold c.mu.
+func (c *Credential) breakerFor(model string) *breaker {
+	if c.breakers == nil {
+		c.breakers = make(map[string]*breaker)
+	}
+	b, ok := c.breakers[model]
+	if !ok {
+		b = &breaker{state: BreakerClosed}
+		c.breakers[model] = b
+	}
+	return b
+}
+
+// allows reports whether model may be sent to c now, moving an open breaker whose
+// cooldown elapsed to half-open. It does not reserve the probe; see claim.
+// Caller must hold c.mu.
+func (c *Credential) allows(model string, now time.Time, cfg BreakerConfig) bool {
+	if until, ok := c.ModelCooldowns[model]; ok && now.Before(until) {
+		return false
+	}
+	b, ok := c.breakers[model]
+	if !ok {
+		return true
+	}
+	switch b.state {
+	case BreakerOpen:
+		b.state = BreakerHalfOpen
+		b.probeAt = time.Time{}
+		return true
+	case BreakerHalfOpen:
+		// One probe at a time; a probe that never reported back is presumed lost
+		return b.probeAt.IsZero() || now.Sub(b.probeAt) > cfg.ProbeTimeout
+	default:
+		return true
+	}
+}
+
+// claim re-checks allows and, for a half-open breaker, takes the probe in the same
+// critical section, so two concurrent picks cannot both probe. Caller must hold c.mu.
+func (c *Credential) claim(model string, now time.Time, cfg BreakerConfig) bool {
+	if !c.allows(model, now, cfg) {
+		return false
+	}
+	if b, ok := c.breakers[model]; ok && b.state == BreakerHalfOpen {
+		b.probeAt = now
+	}
+	return true
+}
+
+// trip opens the breaker for model. Caller must hold c.mu.
+func (c *Credential) trip(b *breaker, model string, cooldown time.Duration, cfg BreakerConfig, now time.Time) {
+	wait := cooldown
+	if wait <= 0 {
+		wait = cfg.OpenDuration
+		for i := 0; i < b.opens && wait < cfg.MaxOpenDuration; i++ {
+			wait *= 2
+		}
+		if wait > cfg.MaxOpenDuration {
+			wait = cfg.MaxOpenDuration
+		}
+	}
+	b.state = BreakerOpen
+	b.failures = 0
+	b.opens++
+	if c.ModelCooldowns == nil {
+		c.ModelCooldowns = make(map[string]time.Time)
+	}
+	c.ModelCooldowns[model] = now.Add(wait)
+}
+
+// breakerInfo returns the admin view of every non-trivial breaker. Caller must hold c.mu.
+func (c *Credential) breakerInfo(now time.Time) map[string]BreakerInfo {
+	infos := make(map[string]BreakerInfo)
+	for model, b := range c.breakers {
+		if b.state == BreakerClosed && b.failures == 0 {
+			continue
+		}
+		info := BreakerInfo{State: b.state, Failures: b.failures}
+		if until, ok := c.ModelCooldowns[model]; ok && now.Before(until) {
+			info.OpenUntil = &until
+		}
+		infos[model] = info
+	}
+	if len(infos) == 0 {
+		return nil
+	}
+	return infos
+}
+
+// RecordError feeds an upstream failure into the credential's breaker for model.
+// Request-caused errors do not count against the credential.
+func (m *Manager) RecordError(cred *Credential, model string, f Failure) {
+	cred.mu.Lock()
+	defer cred.mu.Unlock()
+
+	now := time.Now()
+	cfg := m.opts.Breaker
+	b := cred.breakerFor(model)
+	class := f.class()
+
+	if class == classRequest {
+		// The credential authenticated and was served; a half-open probe succeeded
+		if b.state == BreakerHalfOpen {
+			b.state = BreakerClosed
+			b.opens = 0
+			delete(cred.ModelCooldowns, model)
+			m.markDirty(cred, true)
+		}
+		return
+	}
+
+	cred.ErrorCount++
+
+	switch class {
+	case classRateLimit:
+		cred.trip(b, model, f.Cooldown, cfg, now)
+	case classAuth, classUpstream:
+		b.failures++
+		if b.state == BreakerHalfOpen || b.failures >= cfg.FailureThreshold {
+			cred.trip(b, model, f.Cooldown, cfg, now)
+		}
+	}
+
+	if class == classAuth {
+		cred.authFailures++
+		if f.StatusCode == 401 || f.Reason == "ACCESS_TOKEN_EXPIRED" {
+			// Token rejected before its recorded expiry: renew it instead of waiting
+			cred.Expiry = now
+			cred.refresh.retryAt = time.Time{}
+			m.kickRefresher()
+		}
+		if cred.authFailures >= cfg.DisableAfter {
+			cred.Disabled = true
+			cred.DisabledReason = fmt.Sprintf("%d consecutive authentication failures (last status %d)", cred.authFailures, f.StatusCode)
+		}
+	}
+
+	m.markDirty(cred, true)
+}
+
+// Abandon frees the half-open probe for model when a request on cred was cancelled
+// before the upstream answered, so the next request may probe instead of waiting out
+// ProbeTimeout. The breaker state is otherwise left as it was.
+func (m *Manager) Abandon(cred *Credential, model string) {
+	cred.mu.Lock()
+	defer cred.mu.Unlock()
+
+	if b, ok := cred.breakers[model]; ok && b.state == BreakerHalfOpen {
+		b.probeAt = time.Time{}
+	}
+}
+
+// RecordSuccess closes the credential's breaker for model after a successful request.
+func (m *Manager) RecordSuccess(cred *Credential, model string) {
+	cred.mu.Lock()
+	defer cred.mu.Unlock()
+
+	cred.authFailures = 0
+	b, ok := cred.breakers[model]
+	if !ok || (b.state == BreakerClosed && b.failures == 0) {
+		return
+	}
+	b.state = BreakerClosed
+	b.failures = 0
+	b.opens = 0
+	if _, ok := cred.ModelCooldowns[model]; ok {
+		delete(cred.ModelCooldowns, model)
+		m.markDirty(cred, true)
+	}
+}
@@ -0,0 +1,66 @@
+package credential
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// halfOpenManager returns a manager with one credential whose breaker for model "m"
+// has finished its open period, so the next pick is the half-open probe.
+func halfOpenManager(t *testing.T) *Manager {
+	t.Helper()
+	store := NewMemoryStore([]*Credential{{ID: "c", AccessToken: "a", Expiry: time.Now().Add(time.Hour)}})
+	m, err := NewManager(store, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { m.Close() })
+	c, err := m.find("c")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.mu.Lock()
+	c.breakerFor("m").state = BreakerOpen
+	c.mu.Unlock()
+	return m
+}
+
+func TestHalfOpenProbeIsExclusive(t *testing.T) {
+	m := halfOpenManager(t)
+
+	var wg sync.WaitGroup
+	var probes atomic.Int32
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := m.GetCredential("m", "", 0); err == nil {
+				probes.Add(1)
+			}
+		}()
+	}
+	wg.Wait()
+	if n := probes.Load(); n != 1 {
+		t.Fatalf("%d concurrent probes handed out, want 1", n)
+	}
+}
+
+func TestAbandonFreesProbe(t *testing.T) {
+	m := halfOpenManager(t)
+
+	cred, err := m.GetCredential("m", "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.GetCredential("m", "", 0); err == nil {
+		t.Fatal("second probe handed out while the first is in flight")
+	}
+
+	m.Release(cred)
+	m.Abandon(cred, "m")
+	if _, err := m.GetCredential("m", "", 0); err != nil {
+		t.Fatalf("probe not freed by Abandon: %v", err)
+	}
+}
@@ -0,0 +1,95 @@
+package credential
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"gateway-go/internal/fsutil"
+)
+
+// FileStore keeps one JSON file per credential in a directory.
+// Writes go to a temp file that is synced and renamed over the old record,
+// so a crash leaves either the previous or the new version on disk.
+type FileStore struct {
+	dir string
+}
+
+func NewFileStore(dir string) (*FileStore, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("create credential dir: %w", err)
+	}
+	return &FileStore{dir: dir}, nil
+}
+
+func (s *FileStore) Load() ([]*Credential, error) {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var creds []*Credential
+	for _, e := range entries {
+		if e.IsDir() || !strings.HasSuffix(e.Name(), ".json") {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(s.dir, e.Name()))
+		if err != nil {
+			return nil, err
+		}
+		var c Credential
+		if err := json.Unmarshal(data, &c); err != nil {
+			return nil, fmt.Errorf("parse %s: %w", e.Name(), err)
+		}
+		// The file name is the ID Save and Delete use, so the record must agree with it
+		id := strings.TrimSuffix(e.Name(), ".json")
+		if !ValidID(id) {
+			return nil, fmt.Errorf("%s: invalid credential id %q", e.Name(), id)
+		}
+		if c.ID == "" {
+			c.ID = id
+		}
+		if c.ID != id {
+			return nil, fmt.Errorf("%s: holds credential id %q, expected %q", e.Name(), c.ID, id)
+		}
+		creds = append(creds, &c)
+	}
+
+	sort.Slice(creds, func(i, j int) bool { return creds[i].ID < creds[j].ID })
+	return creds, nil
+}
+
+func (s *FileStore) Save(creds ...*Credential) error {
+	for _, c := range creds {
+		if !ValidID(c.ID) {
+			return fmt.Errorf("invalid credential id %q", c.ID)
+		}
+		data, err := json.MarshalIndent(c, "", "  ")
+		if err != nil {
+			return err
+		}
+		if err := fsutil.WriteFileAtomic(filepath.Join(s.dir, c.ID+".json"), data); err != nil {
+			return fmt.Errorf("save %s: %w", c.ID, err)
+		}
+	}
+	return fsutil.SyncDir(s.dir)
+}
+
+func (s *FileStore) Delete(id string) error {
+	if !ValidID(id) {
+		return fmt.Errorf("invalid credential id %q", id)
+	}
+	err := os.Remove(filepath.Join(s.dir, id+".json"))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return fsutil.SyncDir(s.dir)
+}
+
+func (s *FileStore) Close() error {
+	return nil
+}
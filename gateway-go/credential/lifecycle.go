@@ -0,0 +1,229 @@
+package credential
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+var (
+	ErrNotFound = errors.New("credential not found")
+	ErrExists   = errors.New("credential already exists")
+	ErrInvalid  = errors.New("invalid credential")
+)
+
+// Info is a read-only view of a credential for admin output. Tokens are never included.
+type Info struct {
+	ID              string                 `json:"id"`
+	Disabled        bool                   `json:"disabled"`
+	DisabledReason  string                 `json:"disabled_reason,omitempty"`
+	Preview         bool                   `json:"preview"`
+	Expiry          time.Time              `json:"expiry"`
+	HasRefreshToken bool                   `json:"has_refresh_token"`
+	ModelCooldowns  map[string]time.Time   `json:"model_cooldowns"`
+	CallCount       int64                  `json:"call_count"`
+	InFlight        int64                  `json:"in_flight"`
+	ErrorCount      int64                  `json:"error_count"`
+	RefreshFailures int                    `json:"refresh_failures"`
+	LastRefreshErr  string                 `json:"last_refresh_error,omitempty"`
+	Quotas          map[string]QuotaStatus `json:"quotas,omitempty"`
+	Breakers        map[string]BreakerInfo `json:"breakers,omitempty"`
+}
+
+// info builds the admin view of c. Caller must hold c.mu.
+func (c *Credential) info() Info {
+	now := time.Now()
+	cooldowns := make(map[string]time.Time)
+	for model, until := range c.ModelCooldowns {
+		if now.Before(until) {
+			cooldowns[model] = until
+		}
+	}
+	return Info{
+		ID:              c.ID,
+		Disabled:        c.Disabled,
+		DisabledReason:  c.DisabledReason,
+		Preview:         c.Preview,
+		Expiry:          c.Expiry,
+		HasRefreshToken: c.RefreshToken != "",
+		ModelCooldowns:  cooldowns,
+		CallCount:       c.CallCount,
+		InFlight:        c.inFlight,
+		ErrorCount:      c.ErrorCount,
+		RefreshFailures: c.refresh.failures,
+		LastRefreshErr:  c.refresh.lastError,
+		Quotas:          c.quotaStatus(now),
+		Breakers:        c.breakerInfo(now),
+	}
+}
+
+// List returns an admin view of every credential.
+func (m *Manager) List() []Info {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	infos := make([]Info, len(m.credentials))
+	for i, c := range m.credentials {
+		c.mu.Lock()
+		infos[i] = c.info()
+		c.mu.Unlock()
+	}
+	return infos
+}
+
+// Get returns the admin view of a single credential.
+func (m *Manager) Get(id string) (Info, error) {
+	c, err := m.find(id)
+	if err != nil {
+		return Info{}, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.info(), nil
+}
+
+// Add registers a new credential and persists it. It is eligible for selection immediately.
+func (m *Manager) Add(cred *Credential) error {
+	if !ValidID(cred.ID) {
+		return fmt.Errorf("%w: bad id %q", ErrInvalid, cred.ID)
+	}
+	if cred.AccessToken == "" && cred.RefreshToken == "" {
+		return fmt.Errorf("%w: needs an access_token or refresh_token", ErrInvalid)
+	}
+	// Without a refresh token the access token is all there is, and a credential is
+	// only handed out while its token is known to be valid
+	if cred.RefreshToken == "" && !time.Now().Add(minTokenValidity).Before(cred.Expiry) {
+		return fmt.Errorf("%w: an access_token without a refresh_token needs an expiry at least %s away", ErrInvalid, minTokenValidity)
+	}
+	if cred.ModelCooldowns == nil {
+		cred.ModelCooldowns = make(map[string]time.Time)
+	}
+	cred.refresh.jitter = randomJitter(m.opts.RefreshJitter)
+
+	// Reserve the ID, then persist without holding m.mu so selection isn't blocked
+	// behind the disk write
+	m.mu.Lock()
+	if m.adding[cred.ID] {
+		m.mu.Unlock()
+		return ErrExists
+	}
+	for _, c := range m.credentials {
+		if c.ID == cred.ID {
+			m.mu.Unlock()
+			return ErrExists
+		}
+	}
+	if m.adding == nil {
+		m.adding = make(map[string]bool)
+	}
+	m.adding[cred.ID] = true
+	m.mu.Unlock()
+
+	// Persist before publishing so a credential never serves traffic without a record
+	m.storeMu.Lock()
+	err := m.store.Save(cred.snapshot())
+	m.storeMu.Unlock()
+
+	m.mu.Lock()
+	delete(m.adding, cred.ID)
+	if err == nil {
+		m.credentials = append(m.credentials, cred)
+	}
+	m.mu.Unlock()
+	if err != nil {
+		return fmt.Errorf("persist credential: %w", err)
+	}
+
+	// Credentials added without a valid access token get one right away
+	m.kickRefresher()
+	return nil
+}
+
+// Remove takes a credential out of rotation and deletes it from the store.
+// Requests already holding it finish normally.
+func (m *Manager) Remove(id string) error {
+	m.mu.Lock()
+	idx := -1
+	for i, c := range m.credentials {
+		if c.ID == id {
+			idx = i
+			break
+		}
+	}
+	if idx < 0 {
+		m.mu.Unlock()
+		return ErrNotFound
+	}
+	removed := m.credentials[idx]
+	m.credentials = append(m.credentials[:idx:idx], m.credentials[idx+1:]...)
+	m.mu.Unlock()
+
+	m.storeMu.Lock()
+	defer m.storeMu.Unlock()
+	removed.mu.Lock()
+	removed.removed = true
+	removed.Disabled = true
+	removed.mu.Unlock()
+	return m.store.Delete(id)
+}
+
+// SetDisabled takes a credential out of (or back into) rotation.
+func (m *Manager) SetDisabled(id string, disabled bool) error {
+	c, err := m.find(id)
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	c.Disabled = disabled
+	c.DisabledReason = ""
+	if disabled {
+		c.DisabledReason = "disabled by admin"
+	} else {
+		c.authFailures = 0
+	}
+	c.mu.Unlock()
+	m.markDirty(c, true)
+	return nil
+}
+
+// ClearCooldowns lifts the cooldown and closes the circuit breaker for the given models,
+// or for all models if none are given.
+func (m *Manager) ClearCooldowns(id string, models ...string) error {
+	c, err := m.find(id)
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	if len(models) == 0 {
+		c.ModelCooldowns = make(map[string]time.Time)
+		c.breakers = nil
+	}
+	for _, model := range models {
+		delete(c.ModelCooldowns, model)
+		delete(c.breakers, model)
+	}
+	c.mu.Unlock()
+	m.markDirty(c, true)
+	return nil
+}
+
+// Refresh renews the credential's access token now, regardless of expiry.
+func (m *Manager) Refresh(id string) error {
+	c, err := m.find(id)
+	if err != nil {
+		return err
+	}
+	return m.refresh(c)
+}
+
+func (m *Manager) find(id string) (*Credential, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	for _, c := range m.credentials {
+		if c.ID == id {
+			return c, nil
+		}
+	}
+	return nil, ErrNotFound
+}
@@ -1,106 +1,325 @@
 package credential
 
 import (
+	"context"
 	"fmt"
-	"math/rand"
+	"log"
 	"net/http"
 	"sync"
+	"sync/atomic"
 	"time"
-	"encoding/json"
-	"io"
 )
 
+// persistInterval bounds how long a non-urgent change (call counters) stays unsaved.
+const persistInterval = time.Second
+
 type Credential struct {
-	ID             string            `json:"id"`
-	AccessToken    string            `json:"access_token"`
-	RefreshToken   string            `json:"refresh_token"`
-	Expiry         time.Time         `json:"expiry"`
-	Disabled       bool              `json:"disabled"`
-	Preview        bool              `json:"preview"`
+	ID             string               `json:"id"`
+	AccessToken    string               `json:"access_token"`
+	RefreshToken   string               `json:"refresh_token"`
+	Expiry         time.Time            `json:"expiry"`
+	Disabled       bool                 `json:"disabled"`
+	Preview        bool                 `json:"preview"`
 	ModelCooldowns map[string]time.Time `json:"model_cooldowns"`
-	CallCount      int64             `json:"call_count"`
-	ErrorCount     int64             `json:"error_count"`
-	mu             sync.Mutex
+	CallCount      int64                `json:"call_count"`
+	ErrorCount     int64                `json:"error_count"`
+	DisabledReason string               `json:"disabled_reason,omitempty"`
+	Quotas         map[string]Quota     `json:"quotas,omitempty"`
+
+	// OAuth client for the refresh-token grant; empty fields fall back to Options.
+	ClientID     string `json:"client_id,omitempty"`
+	ClientSecret string `json:"client_secret,omitempty"`
+	TokenURL     string `json:"token_url,omitempty"`
+
+	mu           sync.Mutex
+	removed      bool
+	refresh      refreshState
+	inFlight     int64
+	usage        map[string]*modelUsage // per-model quota consumption, in memory only
+	breakers     map[string]*breaker    // per-model circuit breakers, in memory only
+	authFailures int                    // consecutive authentication failures across models
+}
+
+// Token returns the current access token. Safe to call while a refresh is running.
+func (c *Credential) Token() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.AccessToken
+}
+
+// snapshot returns an unlocked copy suitable for persisting. Caller must hold c.mu.
+func (c *Credential) snapshot() *Credential {
+	cooldowns := make(map[string]time.Time, len(c.ModelCooldowns))
+	for model, until := range c.ModelCooldowns {
+		cooldowns[model] = until
+	}
+	var quotas map[string]Quota
+	if c.Quotas != nil {
+		quotas = make(map[string]Quota, len(c.Quotas))
+		for model, q := range c.Quotas {
+			quotas[model] = q
+		}
+	}
+	return &Credential{
+		ID:             c.ID,
+		AccessToken:    c.AccessToken,
+		RefreshToken:   c.RefreshToken,
+		Expiry:         c.Expiry,
+		Disabled:       c.Disabled,
+		Preview:        c.Preview,
+		ModelCooldowns: cooldowns,
+		CallCount:      c.CallCount,
+		ErrorCount:     c.ErrorCount,
+		DisabledReason: c.DisabledReason,
+		Quotas:         quotas,
+		ClientID:       c.ClientID,
+		ClientSecret:   c.ClientSecret,
+		TokenURL:       c.TokenURL,
+	}
+}
+
+// Options configures a Manager.
+type Options struct {
+	// TokenURL is the OAuth2 token endpoint used for credentials without their own.
+	TokenURL string
+	// ClientID and ClientSecret authenticate the refresh-token grant for credentials
+	// that do not carry their own client.
+	ClientID     string
+	ClientSecret string
+
+	// RefreshLead is how long before expiry the background refresher renews a token.
+	RefreshLead time.Duration
+	// RefreshJitter spreads renewals: each credential renews up to this much earlier
+	// than RefreshLead. Negative disables jitter.
+	RefreshJitter time.Duration
+	// RefreshInterval is how often the refresher scans for due credentials.
+	RefreshInterval time.Duration
+	// RefreshConcurrency bounds simultaneous token endpoint calls.
+	RefreshConcurrency int
+
+	// Selector picks among available credentials. Defaults to RandomSelector.
+	Selector Selector
+
+	// Breaker configures the per credential×model circuit breakers.
+	Breaker BreakerConfig
 }
 
 type Manager struct {
 	mu          sync.RWMutex
 	credentials []*Credential
-	refreshURL  string
+	adding      map[string]bool // IDs reserved by an Add still persisting
+	opts        Options
 	httpClient  *http.Client
+
+	store   Store
+	storeMu sync.Mutex // serializes store writes so a removed credential is never re-saved
+	dirtyMu sync.Mutex
+	dirty   map[string]*Credential
+	flushCh chan struct{}
+	done    chan struct{}
+	wg      sync.WaitGroup
+
+	ctx              context.Context // cancelled on Close to abort in-flight refreshes
+	cancel           context.CancelFunc
+	stopRefresh      chan struct{}
+	refreshKick      chan struct{}
+	refreshWG        sync.WaitGroup
+	refreshSuccess   atomic.Int64
+	refreshFailure   atomic.Int64
+	refreshPermanent atomic.Int64
 }
 
-func NewManager(count int, refreshURL string) *Manager {
-	creds := make([]*Credential, count)
-	for i := 0; i < count; i++ {
-		creds[i] = &Credential{
-			ID:             fmt.Sprintf("cred_%03d", i+1),
-			AccessToken:    fmt.Sprintf("mock_token_%03d", i+1),
-			RefreshToken:   fmt.Sprintf("mock_refresh_%03d", i+1),
-			Expiry:         time.Now().Add(time.Duration(60+rand.Intn(3540)) * time.Second), // 1-60 min
-			ModelCooldowns: make(map[string]time.Time),
+// NewManager loads all credentials from store, starts persisting changes back to it
+// and starts the background token refresher. Call Close to stop both.
+func NewManager(store Store, opts Options) (*Manager, error) {
+	creds, err := store.Load()
+	if err != nil {
+		return nil, fmt.Errorf("load credentials: %w", err)
+	}
+
+	opts.setRefreshDefaults()
+	opts.Breaker.setDefaults()
+	if opts.Selector == nil {
+		opts.Selector = RandomSelector{}
+	}
+
+	// Remove and every store write go by ID, so two records with one ID can't be told apart
+	seen := make(map[string]bool, len(creds))
+	for _, c := range creds {
+		if !ValidID(c.ID) {
+			return nil, fmt.Errorf("load credentials: invalid credential id %q", c.ID)
 		}
+		if seen[c.ID] {
+			return nil, fmt.Errorf("load credentials: duplicate credential id %q", c.ID)
+		}
+		seen[c.ID] = true
 	}
 
-	return &Manager{
+	now := time.Now()
+	for _, c := range creds {
+		if c.ModelCooldowns == nil {
+			c.ModelCooldowns = make(map[string]time.Time)
+		}
+		for model, until := range c.ModelCooldowns {
+			if now.After(until) {
+				delete(c.ModelCooldowns, model)
+				continue
+			}
+			// Still cooling down from before the restart: probe once it elapses
+			c.breakerFor(model).state = BreakerOpen
+		}
+		c.refresh.jitter = randomJitter(opts.RefreshJitter)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	m := &Manager{
 		credentials: creds,
-		refreshURL:  refreshURL,
+		opts:        opts,
 		httpClient: &http.Client{
 			Timeout: 10 * time.Second,
 		},
+		store:   store,
+		dirty:   make(map[string]*Credential),
+		flushCh: make(chan struct{}, 1),
+		done:    make(chan struct{}),
+
+		ctx:         ctx,
+		cancel:      cancel,
+		stopRefresh: make(chan struct{}),
+		refreshKick: make(chan struct{}, 1),
 	}
+
+	m.wg.Add(1)
+	go m.persistLoop()
+
+	m.refreshWG.Add(1)
+	go m.refreshLoop()
+
+	return m, nil
 }
 
-// GetCredential returns a random available credential, filtering by disabled/cooldown.
-func (m *Manager) GetCredential(model string) (*Credential, error) {
+// Count returns the number of loaded credentials.
+func (m *Manager) Count() int {
 	m.mu.RLock()
 	defer m.mu.RUnlock()
+	return len(m.credentials)
+}
 
-	now := time.Now()
-	var available []*Credential
+// Close stops the refresher, flushes pending changes and closes the store.
+func (m *Manager) Close() error {
+	close(m.stopRefresh)
+	m.cancel()
+	m.refreshWG.Wait()
 
-	for _, c := range m.credentials {
-		c.mu.Lock()
-		if c.Disabled {
-			c.mu.Unlock()
-			continue
+	close(m.done)
+	m.wg.Wait()
+	return m.store.Close()
+}
+
+// markDirty queues cred for persisting. Urgent changes (tokens, cooldowns, disabling)
+// are written right away; others are batched until the next persist tick.
+func (m *Manager) markDirty(cred *Credential, urgent bool) {
+	m.dirtyMu.Lock()
+	m.dirty[cred.ID] = cred
+	m.dirtyMu.Unlock()
+
+	if urgent {
+		select {
+		case m.flushCh <- struct{}{}:
+		default:
 		}
-		// Check model-level cooldown
-		if cooldown, ok := c.ModelCooldowns[model]; ok && now.Before(cooldown) {
-			c.mu.Unlock()
-			continue
+	}
+}
+
+func (m *Manager) persistLoop() {
+	defer m.wg.Done()
+
+	ticker := time.NewTicker(persistInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-m.flushCh:
+			m.flush()
+		case <-ticker.C:
+			m.flush()
+		case <-m.done:
+			m.flush()
+			return
 		}
-		c.mu.Unlock()
-		available = append(available, c)
 	}
+}
 
-	if len(available) == 0 {
-		return nil, fmt.Errorf("no available credentials for model %s", model)
+func (m *Manager) flush() {
+	m.dirtyMu.Lock()
+	pending := m.dirty
+	m.dirty = make(map[string]*Credential)
+	m.dirtyMu.Unlock()
+
+	if len(pending) == 0 {
+		return
 	}
 
-	chosen := available[rand.Intn(len(available))]
+	m.storeMu.Lock()
+	defer m.storeMu.Unlock()
 
-	// Check if token needs refresh
-	chosen.mu.Lock()
-	defer chosen.mu.Unlock()
+	snaps := make([]*Credential, 0, len(pending))
+	for _, c := range pending {
+		c.mu.Lock()
+		if !c.removed {
+			snaps = append(snaps, c.snapshot())
+		}
+		c.mu.Unlock()
+	}
+	if len(snaps) == 0 {
+		return
+	}
 
-	if time.Until(chosen.Expiry) <= 120*time.Second {
-		if err := m.refreshToken(chosen); err != nil {
-			return nil, fmt.Errorf("token refresh failed for %s: %w", chosen.ID, err)
+	if err := m.store.Save(snaps...); err != nil {
+		log.Printf("credential: persist %d credentials: %v", len(snaps), err)
+		// Requeue so the next tick retries; newer changes already queued win.
+		m.dirtyMu.Lock()
+		for id, c := range pending {
+			if _, ok := m.dirty[id]; !ok {
+				m.dirty[id] = c
+			}
 		}
+		m.dirtyMu.Unlock()
 	}
+}
 
-	chosen.CallCount++
-	return chosen, nil
+// GetCredential picks an available credential with the configured Selector, filtering
+// by disabled/open circuit breaker. key is the caller's affinity key for sticky selection and may
+// be empty. Only credentials with a valid token are returned; renewal happens in the
+// background. estimatedTokens is the request's estimated size, which must fit the
+// credential's token quota. Call Release when the request using the credential has
+// finished.
+func (m *Manager) GetCredential(model string, key string, estimatedTokens int) (*Credential, error) {
+	return m.pick(model, "", key, estimatedTokens)
 }
 
 // PreWarmCredential gets the next available credential in a non-blocking way.
-func (m *Manager) PreWarmCredential(model string, exclude string) (*Credential, error) {
+func (m *Manager) PreWarmCredential(model string, exclude string, key string, estimatedTokens int) (*Credential, error) {
+	return m.pick(model, exclude, key, estimatedTokens)
+}
+
+// Release marks a request on cred as finished for in-flight accounting.
+func (m *Manager) Release(cred *Credential) {
+	cred.mu.Lock()
+	if cred.inFlight > 0 {
+		cred.inFlight--
+	}
+	cred.mu.Unlock()
+}
+
+func (m *Manager) pick(model string, exclude string, key string, estimatedTokens int) (*Credential, error) {
 	m.mu.RLock()
 	defer m.mu.RUnlock()
 
 	now := time.Now()
-	var available []*Credential
+	var available []Candidate
+	expired := false
+	overQuota := 0
 
 	for _, c := range m.credentials {
 		c.mu.Lock()
@@ -108,91 +327,66 @@ func (m *Manager) PreWarmCredential(model string, exclude string) (*Credential,
 			c.mu.Unlock()
 			continue
 		}
-		if cooldown, ok := c.ModelCooldowns[model]; ok && now.Before(cooldown) {
+		if !c.usable(now) {
+			// Only worth waking the refresher if it has something to do
+			expired = expired || c.needsRefresh(now, m.opts.RefreshLead)
+			c.mu.Unlock()
+			continue
+		}
+		if !c.withinQuota(model, now, int64(estimatedTokens)) {
+			overQuota++
 			c.mu.Unlock()
 			continue
 		}
+		// Check model-level circuit breaker last; a half-open probe is claimed once chosen
+		if !c.allows(model, now, m.opts.Breaker) {
+			c.mu.Unlock()
+			continue
+		}
+		available = append(available, Candidate{
+			Cred:       c,
+			InFlight:   c.inFlight,
+			CallCount:  c.CallCount,
+			ErrorCount: c.ErrorCount,
+		})
 		c.mu.Unlock()
-		available = append(available, c)
 	}
 
-	if len(available) == 0 {
-		return nil, fmt.Errorf("no available credentials for model %s (excluding %s)", model, exclude)
+	if expired {
+		// The refresher fell behind; don't wait for its next tick
+		m.kickRefresher()
 	}
 
-	chosen := available[rand.Intn(len(available))]
-
-	chosen.mu.Lock()
-	defer chosen.mu.Unlock()
-
-	if time.Until(chosen.Expiry) <= 120*time.Second {
-		if err := m.refreshToken(chosen); err != nil {
-			return nil, fmt.Errorf("token refresh failed for %s: %w", chosen.ID, err)
+	if len(available) == 0 {
+		detail := ""
+		if exclude != "" {
+			detail = " (excluding " + exclude + ")"
 		}
-	}
-
-	chosen.CallCount++
-	return chosen, nil
-}
-
-func (m *Manager) refreshToken(cred *Credential) error {
-	resp, err := m.httpClient.Post(m.refreshURL, "application/json", nil)
-	if err != nil {
-		return err
-	}
-	defer resp.Body.Close()
-
-	body, _ := io.ReadAll(resp.Body)
-
-	if resp.StatusCode != 200 {
-		if isPermanentRefreshError(resp.StatusCode) {
-			cred.Disabled = true
-			return fmt.Errorf("permanent refresh failure (status %d), credential disabled", resp.StatusCode)
+		if overQuota > 0 {
+			detail += fmt.Sprintf(" (%d over quota)", overQuota)
 		}
-		return fmt.Errorf("temporary refresh failure (status %d): %s", resp.StatusCode, string(body))
+		return nil, fmt.Errorf("no available credentials for model %s%s", model, detail)
 	}
 
-	var result map[string]any
-	if err := json.Unmarshal(body, &result); err != nil {
-		return err
-	}
+	for len(available) > 0 {
+		i := m.opts.Selector.Select(available, key)
+		chosen := available[i].Cred
 
-	if token, ok := result["access_token"].(string); ok {
-		cred.AccessToken = token
-	}
-	if expiresIn, ok := result["expires_in"].(float64); ok {
-		cred.Expiry = time.Now().Add(time.Duration(expiresIn) * time.Second)
-	}
-
-	return nil
-}
-
-func isPermanentRefreshError(statusCode int) bool {
-	switch statusCode {
-	case 400, 401, 403:
-		return true
-	default:
-		return false
-	}
-}
-
-// RecordError records an error for a credential and handles cooldowns/disabling.
-func (m *Manager) RecordError(cred *Credential, statusCode int, model string, cooldownSeconds int) {
-	cred.mu.Lock()
-	defer cred.mu.Unlock()
-
-	cred.ErrorCount++
-
-	switch statusCode {
-	case 429, 503:
-		if cooldownSeconds > 0 {
-			cred.ModelCooldowns[model] = time.Now().Add(time.Duration(cooldownSeconds) * time.Second)
-		} else {
-			cred.ModelCooldowns[model] = time.Now().Add(30 * time.Second) // default 30s
+		chosen.mu.Lock()
+		// A concurrent pick may have taken the half-open probe since the scan
+		if !chosen.claim(model, now, m.opts.Breaker) {
+			chosen.mu.Unlock()
+			available = append(available[:i], available[i+1:]...)
+			continue
 		}
-	case 400, 403:
-		cred.Disabled = true
+		chosen.CallCount++
+		chosen.inFlight++
+		chosen.countRequest(model, now)
+		chosen.mu.Unlock()
+		m.markDirty(chosen, false)
+		return chosen, nil
 	}
+	return nil, fmt.Errorf("no available credentials for model %s", model)
 }
 
 // GetStats returns credential statistics.
@@ -204,12 +398,13 @@ func (m *Manager) GetStats() []map[string]any {
 	for i, c := range m.credentials {
 		c.mu.Lock()
 		stats[i] = map[string]any{
-			"id":         c.ID,
-			"disabled":   c.Disabled,
-			"call_count": c.CallCount,
+			"id":          c.ID,
+			"disabled":    c.Disabled,
+			"call_count":  c.CallCount,
+			"in_flight":   c.inFlight,
 			"error_count": c.ErrorCount,
-			"expiry":     c.Expiry.Format(time.RFC3339),
-			"cooldowns":  len(c.ModelCooldowns),
+			"expiry":      c.Expiry.Format(time.RFC3339),
+			"cooldowns":   len(c.ModelCooldowns),
 		}
 		c.mu.Unlock()
 	}
@@ -0,0 +1,176 @@
+package credential
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// defaultTokenLifetime is assumed when the token endpoint omits expires_in.
+const defaultTokenLifetime = time.Hour
+
+// tokenResponse is the RFC 6749 §5.1 success body.
+type tokenResponse struct {
+	AccessToken  string `json:"access_token"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int64  `json:"expires_in"`
+	RefreshToken string `json:"refresh_token"`
+}
+
+// tokenErrorResponse is the RFC 6749 §5.2 error body.
+type tokenErrorResponse struct {
+	Error            string `json:"error"`
+	ErrorDescription string `json:"error_description"`
+}
+
+// RefreshError is returned when the token endpoint rejects a refresh-token grant.
+type RefreshError struct {
+	StatusCode  int
+	Code        string // OAuth error code, e.g. "invalid_grant"; empty if the body was not an OAuth error
+	Description string
+	// Permanent means retrying with this refresh token cannot succeed.
+	Permanent bool
+}
+
+func (e *RefreshError) Error() string {
+	kind := "temporary"
+	if e.Permanent {
+		kind = "permanent"
+	}
+	msg := fmt.Sprintf("%s refresh failure (status %d", kind, e.StatusCode)
+	if e.Code != "" {
+		msg += ", " + e.Code
+	}
+	msg += ")"
+	if e.Description != "" {
+		msg += ": " + e.Description
+	}
+	return msg
+}
+
+// refreshGrant is everything needed to run a refresh-token grant, copied out of a
+// Credential so the HTTP exchange can run without holding its lock.
+type refreshGrant struct {
+	tokenURL     string
+	refreshToken string
+	clientID     string
+	clientSecret string
+}
+
+// grantFor builds the refresh grant for cred. Caller must hold cred.mu.
+func (m *Manager) grantFor(cred *Credential) refreshGrant {
+	return refreshGrant{
+		tokenURL:     firstNonEmpty(cred.TokenURL, m.opts.TokenURL),
+		refreshToken: cred.RefreshToken,
+		clientID:     firstNonEmpty(cred.ClientID, m.opts.ClientID),
+		clientSecret: firstNonEmpty(cred.ClientSecret, m.opts.ClientSecret),
+	}
+}
+
+// exchangeRefreshToken runs the refresh-token grant against the token endpoint.
+func (m *Manager) exchangeRefreshToken(ctx context.Context, grant refreshGrant) (*tokenResponse, error) {
+	if grant.refreshToken == "" {
+		return nil, errors.New("no refresh token")
+	}
+
+	form := url.Values{
+		"grant_type":    {"refresh_token"},
+		"refresh_token": {grant.refreshToken},
+	}
+	if grant.clientID != "" {
+		form.Set("client_id", grant.clientID)
+	}
+	if grant.clientSecret != "" {
+		form.Set("client_secret", grant.clientSecret)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", grant.tokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := m.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+
+	if resp.StatusCode != 200 {
+		return nil, parseRefreshError(resp.StatusCode, body)
+	}
+
+	var result tokenResponse
+	if err := json.Unmarshal(body, &result); err != nil {
+		return nil, fmt.Errorf("parse token response: %w", err)
+	}
+	if result.AccessToken == "" {
+		return nil, errors.New("token response has no access_token")
+	}
+	if result.TokenType != "" && !strings.EqualFold(result.TokenType, "bearer") {
+		return nil, fmt.Errorf("unsupported token_type %q", result.TokenType)
+	}
+
+	return &result, nil
+}
+
+// applyToken stores a successful grant result on cred. Caller must hold cred.mu.
+func applyToken(cred *Credential, result *tokenResponse) {
+	lifetime := defaultTokenLifetime
+	if result.ExpiresIn > 0 {
+		lifetime = time.Duration(result.ExpiresIn) * time.Second
+	}
+
+	cred.AccessToken = result.AccessToken
+	cred.Expiry = time.Now().Add(lifetime)
+	// Servers that rotate refresh tokens invalidate the old one
+	if result.RefreshToken != "" {
+		cred.RefreshToken = result.RefreshToken
+	}
+}
+
+func parseRefreshError(statusCode int, body []byte) *RefreshError {
+	refreshErr := &RefreshError{StatusCode: statusCode}
+
+	var oauthErr tokenErrorResponse
+	if json.Unmarshal(body, &oauthErr) == nil && oauthErr.Error != "" {
+		refreshErr.Code = oauthErr.Error
+		refreshErr.Description = oauthErr.ErrorDescription
+		refreshErr.Permanent = isPermanentOAuthError(oauthErr.Error)
+		return refreshErr
+	}
+
+	refreshErr.Description = strings.TrimSpace(string(body))
+	refreshErr.Permanent = statusCode == 401 || statusCode == 403
+	return refreshErr
+}
+
+// isPermanentOAuthError reports whether the OAuth error code means the refresh token
+// or client is no longer usable. Everything else (invalid_request, server_error,
+// temporarily_unavailable, ...) is worth retrying.
+func isPermanentOAuthError(code string) bool {
+	switch code {
+	case "invalid_grant", "invalid_client", "unauthorized_client":
+		return true
+	default:
+		return false
+	}
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, v := range values {
+		if v != "" {
+			return v
+		}
+	}
+	return ""
+}
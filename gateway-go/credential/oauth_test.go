@@ -0,0 +1,108 @@
+package credential
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRefreshErrorClassification(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		status    int
+		body      string
+		code      string
+		permanent bool
+	}{
+		{"invalid_grant", 400, `{"error": "invalid_grant", "error_description": "Token has been expired or revoked."}`, "invalid_grant", true},
+		{"invalid_client", 401, `{"error": "invalid_client"}`, "invalid_client", true},
+		{"unauthorized_client", 400, `{"error": "unauthorized_client"}`, "unauthorized_client", true},
+		{"invalid_request", 400, `{"error": "invalid_request"}`, "invalid_request", false},
+		{"server_error", 500, `{"error": "server_error"}`, "server_error", false},
+		{"temporarily_unavailable", 503, `{"error": "temporarily_unavailable"}`, "temporarily_unavailable", false},
+		{"unknown code on 401", 401, `{"error": "something_new"}`, "something_new", false},
+		{"plain 401", 401, `Unauthorized`, "", true},
+		{"plain 403", 403, `Forbidden`, "", true},
+		{"plain 500", 500, `<html>oops</html>`, "", false},
+		{"plain 429", 429, ``, "", false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(tc.status)
+				w.Write([]byte(tc.body))
+			}))
+			defer srv.Close()
+
+			store := NewMemoryStore([]*Credential{{
+				ID: "c", AccessToken: "a", RefreshToken: "r", Expiry: time.Now().Add(time.Hour), TokenURL: srv.URL,
+			}})
+			m, err := NewManager(store, Options{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer m.Close()
+			c, err := m.find("c")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			err = m.refresh(c)
+			var refreshErr *RefreshError
+			if !errors.As(err, &refreshErr) {
+				t.Fatalf("refresh error = %v, want a RefreshError", err)
+			}
+			if refreshErr.StatusCode != tc.status || refreshErr.Code != tc.code || refreshErr.Permanent != tc.permanent {
+				t.Errorf("got status %d code %q permanent %v, want %d %q %v",
+					refreshErr.StatusCode, refreshErr.Code, refreshErr.Permanent, tc.status, tc.code, tc.permanent)
+			}
+
+			c.mu.Lock()
+			defer c.mu.Unlock()
+			if c.Disabled != tc.permanent {
+				t.Errorf("disabled = %v, want %v", c.Disabled, tc.permanent)
+			}
+			if retry := !c.refresh.retryAt.IsZero(); retry == tc.permanent {
+				t.Errorf("retry scheduled = %v for a permanent = %v failure", retry, tc.permanent)
+			}
+		})
+	}
+}
+
+func TestRefreshSuccess(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			t.Error(err)
+		}
+		if r.Form.Get("grant_type") != "refresh_token" || r.Form.Get("refresh_token") != "r" || r.Form.Get("client_id") != "id" {
+			t.Errorf("unexpected grant %v", r.Form)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"access_token": "new", "token_type": "Bearer", "expires_in": 600, "refresh_token": "r2"}`))
+	}))
+	defer srv.Close()
+
+	store := NewMemoryStore([]*Credential{{ID: "c", RefreshToken: "r", Expiry: time.Now().Add(time.Hour)}})
+	m, err := NewManager(store, Options{TokenURL: srv.URL, ClientID: "id"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+	c, err := m.find("c")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := m.refresh(c); err != nil {
+		t.Fatal(err)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.AccessToken != "new" || c.RefreshToken != "r2" {
+		t.Errorf("tokens = %q, %q", c.AccessToken, c.RefreshToken)
+	}
+	if left := time.Until(c.Expiry); left < 9*time.Minute || left > 10*time.Minute {
+		t.Errorf("expiry in %v, want about 10m", left)
+	}
+}
@@ -0,0 +1,192 @@
+package credential
+
+import (
+	"fmt"
+	"time"
+
+	"gateway-go/internal/window"
+)
+
+// QuotaAnyModel is the Quotas key whose limits apply to every model without its own entry.
+const QuotaAnyModel = "*"
+
+// Quota limits one model's usage on a credential. Zero means unlimited.
+type Quota struct {
+	RPM int64 `json:"rpm,omitempty"` // requests per minute
+	RPD int64 `json:"rpd,omitempty"` // requests per day
+	TPM int64 `json:"tpm,omitempty"` // tokens (input + output) per minute
+}
+
+// QuotaUsage is consumption within the current sliding windows. Usage is kept in
+// memory only and starts from zero after a restart, so a credential restarted late
+// in the day may exceed its RPD before the old requests age out.
+type QuotaUsage struct {
+	RequestsMinute int64 `json:"requests_minute"`
+	RequestsDay    int64 `json:"requests_day"`
+	TokensMinute   int64 `json:"tokens_minute"`
+}
+
+// QuotaStatus is the admin view of one model's quota on a credential.
+// Remaining is -1 for unlimited dimensions.
+type QuotaStatus struct {
+	Limit     Quota      `json:"limit"`
+	Used      QuotaUsage `json:"used"`
+	Remaining QuotaUsage `json:"remaining"`
+}
+
+// modelUsage tracks one model's consumption on a credential.
+type modelUsage struct {
+	requestsMinute window.Counter
+	requestsDay    window.Counter
+	tokensMinute   window.Counter
+}
+
+func newModelUsage() *modelUsage {
+	return &modelUsage{
+		requestsMinute: window.New(time.Minute, time.Second),
+		requestsDay:    window.New(24*time.Hour, 15*time.Minute),
+		tokensMinute:   window.New(time.Minute, time.Second),
+	}
+}
+
+func (u *modelUsage) current(now time.Time) QuotaUsage {
+	return QuotaUsage{
+		RequestsMinute: u.requestsMinute.Sum(now),
+		RequestsDay:    u.requestsDay.Sum(now),
+		TokensMinute:   u.tokensMinute.Sum(now),
+	}
+}
+
+// quotaFor returns the quota that applies to model, if any. Caller must hold c.mu.
+func (c *Credential) quotaFor(model string) (Quota, bool) {
+	if q, ok := c.Quotas[model]; ok {
+		return q, true
+	}
+	q, ok := c.Quotas[QuotaAnyModel]
+	return q, ok
+}
+
+// usageFor returns the usage tracker for model, creating it. Caller must hold c.mu.
+func (c *Credential) usageFor(model string) *modelUsage {
+	if c.usage == nil {
+		c.usage = make(map[string]*modelUsage)
+	}
+	u, ok := c.usage[model]
+	if !ok {
+		u = newModelUsage()
+		c.usage[model] = u
+	}
+	return u
+}
+
+// withinQuota reports whether one more request for model, estimated at tokens, fits
+// c's budget. Tokens already settled in the window count as used.
+// Caller must hold c.mu.
+func (c *Credential) withinQuota(model string, now time.Time, tokens int64) bool {
+	q, ok := c.quotaFor(model)
+	if !ok {
+		return true
+	}
+	var used QuotaUsage
+	if u, ok := c.usage[model]; ok {
+		used = u.current(now)
+	}
+	if q.RPM > 0 && used.RequestsMinute+1 > q.RPM {
+		return false
+	}
+	if q.RPD > 0 && used.RequestsDay+1 > q.RPD {
+		return false
+	}
+	if q.TPM > 0 && used.TokensMinute+tokens > q.TPM {
+		return false
+	}
+	return true
+}
+
+// countRequest charges one request for model against c. Caller must hold c.mu.
+func (c *Credential) countRequest(model string, now time.Time) {
+	if _, ok := c.quotaFor(model); !ok {
+		return
+	}
+	u := c.usageFor(model)
+	u.requestsMinute.Add(now, 1)
+	u.requestsDay.Add(now, 1)
+}
+
+// quotaStatus returns the remaining-quota view for every limited model c has served
+// or has an explicit limit for. Caller must hold c.mu.
+func (c *Credential) quotaStatus(now time.Time) map[string]QuotaStatus {
+	if len(c.Quotas) == 0 {
+		return nil
+	}
+
+	status := make(map[string]QuotaStatus)
+	report := func(model string) {
+		q, ok := c.quotaFor(model)
+		if !ok {
+			return
+		}
+		var used QuotaUsage
+		if u, ok := c.usage[model]; ok {
+			used = u.current(now)
+		}
+		status[model] = QuotaStatus{
+			Limit: q,
+			Used:  used,
+			Remaining: QuotaUsage{
+				RequestsMinute: remaining(q.RPM, used.RequestsMinute),
+				RequestsDay:    remaining(q.RPD, used.RequestsDay),
+				TokensMinute:   remaining(q.TPM, used.TokensMinute),
+			},
+		}
+	}
+	for model := range c.Quotas {
+		if model != QuotaAnyModel {
+			report(model)
+		}
+	}
+	for model := range c.usage {
+		report(model)
+	}
+	return status
+}
+
+func remaining(limit, used int64) int64 {
+	if limit <= 0 {
+		return -1
+	}
+	if used >= limit {
+		return 0
+	}
+	return limit - used
+}
+
+// RecordUsage settles the tokens a finished request consumed on cred, using the same
+// figures recorded in token.Stats.
+func (m *Manager) RecordUsage(cred *Credential, model string, inputTokens, outputTokens int) {
+	cred.mu.Lock()
+	defer cred.mu.Unlock()
+
+	if _, ok := cred.quotaFor(model); !ok {
+		return
+	}
+	cred.usageFor(model).tokensMinute.Add(time.Now(), int64(inputTokens+outputTokens))
+}
+
+// SetQuotas replaces a credential's per-model limits. Consumption already tracked is kept.
+func (m *Manager) SetQuotas(id string, quotas map[string]Quota) error {
+	for model, q := range quotas {
+		if q.RPM < 0 || q.RPD < 0 || q.TPM < 0 {
+			return fmt.Errorf("%w: negative quota for %s", ErrInvalid, model)
+		}
+	}
+	c, err := m.find(id)
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	c.Quotas = quotas
+	c.mu.Unlock()
+	m.markDirty(c, true)
+	return nil
+}
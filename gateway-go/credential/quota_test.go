@@ -0,0 +1,57 @@
+package credential
+
+import (
+	"testing"
+	"time"
+)
+
+func TestWithinQuotaCountsEstimate(t *testing.T) {
+	now := time.Now()
+	c := &Credential{ID: "c", Quotas: map[string]Quota{QuotaAnyModel: {TPM: 1000}}}
+	c.usageFor("m").tokensMinute.Add(now, 600)
+
+	for _, tc := range []struct {
+		estimate int64
+		want     bool
+	}{
+		{0, true},
+		{400, true},
+		{401, false},
+		{5000, false},
+	} {
+		if got := c.withinQuota("m", now, tc.estimate); got != tc.want {
+			t.Errorf("withinQuota with %d more tokens = %v, want %v", tc.estimate, got, tc.want)
+		}
+	}
+
+	// A request larger than the whole budget never fits, even on an idle credential
+	idle := &Credential{ID: "idle", Quotas: map[string]Quota{"m": {TPM: 1000}}}
+	if idle.withinQuota("m", now, 1500) {
+		t.Error("request over the whole TPM budget admitted")
+	}
+}
+
+func TestWithinQuotaRequests(t *testing.T) {
+	now := time.Now()
+	c := &Credential{ID: "c", Quotas: map[string]Quota{"m": {RPM: 2, RPD: 3}}}
+	for i := 0; i < 2; i++ {
+		if !c.withinQuota("m", now, 0) {
+			t.Fatalf("request %d rejected", i+1)
+		}
+		c.countRequest("m", now)
+	}
+	if c.withinQuota("m", now, 0) {
+		t.Error("third request within a minute admitted with RPM 2")
+	}
+	later := now.Add(2 * time.Minute)
+	if !c.withinQuota("m", later, 0) {
+		t.Error("request rejected after the minute window passed")
+	}
+	c.countRequest("m", later)
+	if c.withinQuota("m", later.Add(2*time.Minute), 0) {
+		t.Error("fourth request in a day admitted with RPD 3")
+	}
+	if !c.withinQuota("other", now, 0) {
+		t.Error("model without a quota rejected")
+	}
+}
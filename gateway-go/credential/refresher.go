@@ -0,0 +1,217 @@
+package credential
+
+import (
+	"errors"
+	"log"
+	"math/rand"
+	"sort"
+	"time"
+)
+
+// Refresher defaults, used when the matching Options field is zero.
+const (
+	defaultRefreshLead        = 5 * time.Minute
+	defaultRefreshJitter      = time.Minute
+	defaultRefreshInterval    = 10 * time.Second
+	defaultRefreshConcurrency = 4
+
+	refreshRetryBase = 15 * time.Second
+	refreshRetryMax  = 5 * time.Minute
+)
+
+// minTokenValidity is how long a token must stay valid for GetCredential to hand it out.
+const minTokenValidity = 30 * time.Second
+
+// refreshCall is an in-flight refresh that concurrent callers wait on.
+type refreshCall struct {
+	done chan struct{}
+	err  error
+}
+
+// refreshState is the refresher's in-memory bookkeeping for one credential.
+type refreshState struct {
+	call      *refreshCall
+	jitter    time.Duration // fixed per credential so renewals spread out
+	failures  int
+	retryAt   time.Time
+	lastError string
+}
+
+// refreshDueAt returns when c should next be renewed. Caller must hold c.mu.
+func (c *Credential) refreshDueAt(lead time.Duration) time.Time {
+	due := c.Expiry.Add(-lead - c.refresh.jitter)
+	if c.refresh.retryAt.After(due) {
+		return c.refresh.retryAt
+	}
+	return due
+}
+
+// needsRefresh reports whether c is due for renewal and none is running or backing
+// off. Caller must hold c.mu.
+func (c *Credential) needsRefresh(now time.Time, lead time.Duration) bool {
+	return !c.Disabled && c.RefreshToken != "" && c.refresh.call == nil &&
+		!now.Before(c.refreshDueAt(lead))
+}
+
+// usable reports whether c can be handed out now. Caller must hold c.mu.
+func (c *Credential) usable(now time.Time) bool {
+	return !c.Disabled && now.Add(minTokenValidity).Before(c.Expiry)
+}
+
+func (o *Options) setRefreshDefaults() {
+	if o.RefreshLead <= 0 {
+		o.RefreshLead = defaultRefreshLead
+	}
+	if o.RefreshJitter < 0 {
+		o.RefreshJitter = 0
+	} else if o.RefreshJitter == 0 {
+		o.RefreshJitter = defaultRefreshJitter
+	}
+	if o.RefreshInterval <= 0 {
+		o.RefreshInterval = defaultRefreshInterval
+	}
+	if o.RefreshConcurrency <= 0 {
+		o.RefreshConcurrency = defaultRefreshConcurrency
+	}
+}
+
+// refreshLoop renews credentials ahead of expiry so the request path never waits on
+// the token endpoint. At most Options.RefreshConcurrency refreshes run at once.
+func (m *Manager) refreshLoop() {
+	defer m.refreshWG.Done()
+
+	ticker := time.NewTicker(m.opts.RefreshInterval)
+	defer ticker.Stop()
+
+	sem := make(chan struct{}, m.opts.RefreshConcurrency)
+	for {
+		m.refreshDue(sem)
+
+		select {
+		case <-ticker.C:
+		case <-m.refreshKick:
+		case <-m.stopRefresh:
+			return
+		}
+	}
+}
+
+// refreshDue starts a refresh for every credential past its due time, soonest expiry first.
+func (m *Manager) refreshDue(sem chan struct{}) {
+	now := time.Now()
+
+	type dueCred struct {
+		cred   *Credential
+		expiry time.Time
+	}
+
+	m.mu.RLock()
+	var due []dueCred
+	for _, c := range m.credentials {
+		c.mu.Lock()
+		if c.needsRefresh(now, m.opts.RefreshLead) {
+			due = append(due, dueCred{cred: c, expiry: c.Expiry})
+		}
+		c.mu.Unlock()
+	}
+	m.mu.RUnlock()
+
+	sort.Slice(due, func(i, j int) bool { return due[i].expiry.Before(due[j].expiry) })
+
+	for _, d := range due {
+		c := d.cred
+		select {
+		case sem <- struct{}{}:
+		case <-m.stopRefresh:
+			return
+		}
+		m.refreshWG.Add(1)
+		go func(c *Credential) {
+			defer m.refreshWG.Done()
+			defer func() { <-sem }()
+			if err := m.refresh(c); err != nil {
+				log.Printf("credential: refresh %s: %v", c.ID, err)
+			}
+		}(c)
+	}
+}
+
+// kickRefresher asks the refresher to rescan now instead of at the next tick.
+func (m *Manager) kickRefresher() {
+	select {
+	case m.refreshKick <- struct{}{}:
+	default:
+	}
+}
+
+// refresh renews c's token, joining a refresh already in flight for c.
+func (m *Manager) refresh(c *Credential) error {
+	c.mu.Lock()
+	if call := c.refresh.call; call != nil {
+		c.mu.Unlock()
+		<-call.done
+		return call.err
+	}
+	call := &refreshCall{done: make(chan struct{})}
+	c.refresh.call = call
+	grant := m.grantFor(c)
+	c.mu.Unlock()
+
+	result, err := m.exchangeRefreshToken(m.ctx, grant)
+
+	c.mu.Lock()
+	if err == nil {
+		applyToken(c, result)
+		c.refresh.failures = 0
+		c.refresh.retryAt = time.Time{}
+		c.refresh.lastError = ""
+		m.refreshSuccess.Add(1)
+	} else {
+		c.refresh.failures++
+		c.refresh.lastError = err.Error()
+		m.refreshFailure.Add(1)
+
+		var refreshErr *RefreshError
+		if errors.As(err, &refreshErr) && refreshErr.Permanent {
+			c.Disabled = true
+			c.DisabledReason = refreshErr.Error()
+			m.refreshPermanent.Add(1)
+		} else {
+			c.refresh.retryAt = time.Now().Add(refreshBackoff(c.refresh.failures))
+		}
+	}
+	c.refresh.call = nil
+	c.mu.Unlock()
+	m.markDirty(c, true)
+
+	call.err = err
+	close(call.done)
+	return err
+}
+
+func refreshBackoff(failures int) time.Duration {
+	delay := refreshRetryBase
+	for i := 1; i < failures && delay < refreshRetryMax; i++ {
+		delay *= 2
+	}
+	if delay > refreshRetryMax {
+		delay = refreshRetryMax
+	}
+	return delay
+}
+
+func randomJitter(max time.Duration) time.Duration {
+	if max <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(max)))
+}
+
+// RefreshStats returns refresher counters since startup.
+func (m *Manager) RefreshStats() map[string]int64 {
+	return map[string]int64{
+		"success":           m.refreshSuccess.Load(),
+		"failure":           m.refreshFailure.Load(),
+		"permanent_failure": m.refreshPermanent.Load(),
+	}
+}
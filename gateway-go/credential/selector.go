@@ -0,0 +1,125 @@
+package credential
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"sync/atomic"
+)
+
+// Candidate is an available credential plus the load figures selectors balance on,
+// captured when the candidate list was built.
+type Candidate struct {
+	Cred       *Credential
+	InFlight   int64
+	CallCount  int64
+	ErrorCount int64
+}
+
+// Selector picks one credential from a non-empty candidate list. key identifies the
+// caller for sticky routing (API key or conversation) and may be empty.
+// Candidates are always in the manager's credential order.
+type Selector interface {
+	Select(candidates []Candidate, key string) int
+}
+
+// NewSelector returns the selector registered under name.
+func NewSelector(name string) (Selector, error) {
+	switch name {
+	case "", "random":
+		return RandomSelector{}, nil
+	case "round-robin":
+		return &RoundRobinSelector{}, nil
+	case "least-loaded":
+		return LeastLoadedSelector{}, nil
+	case "weighted":
+		return WeightedSelector{}, nil
+	case "sticky":
+		return &StickySelector{Fallback: &RoundRobinSelector{}}, nil
+	default:
+		return nil, fmt.Errorf("unknown credential selector %q", name)
+	}
+}
+
+// RandomSelector picks uniformly at random.
+type RandomSelector struct{}
+
+func (RandomSelector) Select(candidates []Candidate, _ string) int {
+	return rand.Intn(len(candidates))
+}
+
+// RoundRobinSelector cycles through candidates in order.
+type RoundRobinSelector struct {
+	next atomic.Uint64
+}
+
+func (s *RoundRobinSelector) Select(candidates []Candidate, _ string) int {
+	return int((s.next.Add(1) - 1) % uint64(len(candidates)))
+}
+
+// LeastLoadedSelector picks the candidate with the fewest in-flight requests,
+// breaking ties by lifetime call count so quota is spread evenly.
+type LeastLoadedSelector struct{}
+
+func (LeastLoadedSelector) Select(candidates []Candidate, _ string) int {
+	best := 0
+	for i, c := range candidates[1:] {
+		b := candidates[best]
+		if c.InFlight < b.InFlight || (c.InFlight == b.InFlight && c.CallCount < b.CallCount) {
+			best = i + 1
+		}
+	}
+	return best
+}
+
+// WeightedSelector picks at random, weighting each candidate by its smoothed success
+// rate squared so credentials that keep failing receive less traffic without being starved.
+type WeightedSelector struct{}
+
+func (WeightedSelector) Select(candidates []Candidate, _ string) int {
+	weights := make([]float64, len(candidates))
+	total := 0.0
+	for i, c := range candidates {
+		errors := c.ErrorCount
+		if errors > c.CallCount {
+			errors = c.CallCount
+		}
+		success := float64(c.CallCount-errors+1) / float64(c.CallCount+1)
+		weights[i] = success * success
+		total += weights[i]
+	}
+
+	r := rand.Float64() * total
+	for i, w := range weights {
+		if r < w {
+			return i
+		}
+		r -= w
+	}
+	return len(candidates) - 1
+}
+
+// StickySelector routes each key to the same credential using rendezvous hashing, so
+// a credential leaving or joining the pool only moves the keys it owned. Requests
+// without a key go to Fallback.
+type StickySelector struct {
+	Fallback Selector
+}
+
+func (s *StickySelector) Select(candidates []Candidate, key string) int {
+	if key == "" {
+		return s.Fallback.Select(candidates, key)
+	}
+
+	best, bestScore := 0, uint64(0)
+	for i, c := range candidates {
+		h := fnv.New64a()
+		h.Write([]byte(key))
+		h.Write([]byte{0})
+		h.Write([]byte(c.Cred.ID))
+		if score := h.Sum64(); i == 0 || score > bestScore {
+			best, bestScore = i, score
+		}
+	}
+	return best
+}
@@ -0,0 +1,106 @@
+package credential
+
+import (
+	"fmt"
+	"testing"
+)
+
+func candidates(ids ...string) []Candidate {
+	out := make([]Candidate, len(ids))
+	for i, id := range ids {
+		out[i] = Candidate{Cred: &Credential{ID: id}}
+	}
+	return out
+}
+
+func TestNewSelector(t *testing.T) {
+	for _, name := range []string{"", "random", "round-robin", "least-loaded", "weighted", "sticky"} {
+		if _, err := NewSelector(name); err != nil {
+			t.Errorf("NewSelector(%q): %v", name, err)
+		}
+	}
+	if _, err := NewSelector("fastest"); err == nil {
+		t.Error("unknown selector accepted")
+	}
+}
+
+func TestRoundRobinSelector(t *testing.T) {
+	s := &RoundRobinSelector{}
+	cands := candidates("a", "b", "c")
+	for i, want := range []int{0, 1, 2, 0, 1, 2, 0} {
+		if got := s.Select(cands, ""); got != want {
+			t.Fatalf("pick %d = %d, want %d", i, got, want)
+		}
+	}
+}
+
+func TestLeastLoadedSelector(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		cands []Candidate
+		want  int
+	}{
+		{"fewest in flight", []Candidate{{InFlight: 3}, {InFlight: 1}, {InFlight: 2}}, 1},
+		{"tie broken by calls", []Candidate{{InFlight: 1, CallCount: 9}, {InFlight: 1, CallCount: 4}, {InFlight: 2}}, 1},
+		{"in flight beats calls", []Candidate{{InFlight: 0, CallCount: 100}, {InFlight: 1, CallCount: 0}}, 0},
+		{"full tie keeps order", []Candidate{{InFlight: 1, CallCount: 5}, {InFlight: 1, CallCount: 5}}, 0},
+		{"single", []Candidate{{InFlight: 7}}, 0},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := (LeastLoadedSelector{}).Select(tc.cands, ""); got != tc.want {
+				t.Errorf("Select = %d, want %d", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestWeightedSelectorFavoursHealthy(t *testing.T) {
+	cands := []Candidate{
+		{Cred: &Credential{ID: "healthy"}, CallCount: 100, ErrorCount: 0},
+		{Cred: &Credential{ID: "failing"}, CallCount: 100, ErrorCount: 90},
+		{Cred: &Credential{ID: "new"}},
+	}
+	counts := make([]int, len(cands))
+	for i := 0; i < 10000; i++ {
+		counts[(WeightedSelector{}).Select(cands, "")]++
+	}
+	// Weights are 1, about 0.01 and 1
+	if counts[1] == 0 || counts[1] > 500 {
+		t.Errorf("failing credential picked %d of 10000 times", counts[1])
+	}
+	if counts[0] < 4000 || counts[2] < 4000 {
+		t.Errorf("healthy and new picked %d and %d of 10000 times", counts[0], counts[2])
+	}
+}
+
+func TestStickySelector(t *testing.T) {
+	s := &StickySelector{Fallback: &RoundRobinSelector{}}
+	ids := []string{"a", "b", "c", "d", "e"}
+	cands := candidates(ids...)
+
+	owners := make(map[string]string)
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		owner := cands[s.Select(cands, key)].Cred.ID
+		if again := cands[s.Select(cands, key)].Cred.ID; again != owner {
+			t.Fatalf("%s moved from %s to %s", key, owner, again)
+		}
+		owners[key] = owner
+	}
+
+	// Removing one credential only moves the keys it owned
+	rest := candidates("a", "b", "d", "e")
+	for key, owner := range owners {
+		got := rest[s.Select(rest, key)].Cred.ID
+		if owner != "c" && got != owner {
+			t.Errorf("%s moved from %s to %s when c left", key, owner, got)
+		}
+	}
+
+	// Without a key the fallback decides
+	for i, want := range []int{0, 1, 2} {
+		if got := s.Select(cands, ""); got != want {
+			t.Fatalf("keyless pick %d = %d, want %d", i, got, want)
+		}
+	}
+}
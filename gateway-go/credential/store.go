@@ -0,0 +1,124 @@
+package credential
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gateway-go/internal/fsutil"
+)
+
+// Store persists credential records so tokens, cooldowns and counters survive restarts.
+type Store interface {
+	// Load returns every stored credential.
+	Load() ([]*Credential, error)
+	// Save writes the given records, replacing existing records with the same ID.
+	Save(creds ...*Credential) error
+	// Delete removes the record with the given ID. Deleting a missing ID is not an error.
+	Delete(id string) error
+	Close() error
+}
+
+// ValidID reports whether id is usable as a credential ID by every store backend.
+func ValidID(id string) bool {
+	return fsutil.ValidName(id)
+}
+
+// OpenStore opens a store from a "kind:location" spec:
+//
+//	dir:/var/lib/gateway/creds   one JSON file per credential
+//	bolt:/var/lib/gateway/creds.db  embedded bbolt database
+//	mock:20                       in-memory synthesized credentials (benchmarks only)
+//
+// A spec without a kind is treated as a directory.
+func OpenStore(spec string) (Store, error) {
+	kind, location, ok := strings.Cut(spec, ":")
+	if !ok {
+		kind, location = "dir", spec
+	}
+	if location == "" {
+		return nil, fmt.Errorf("credential store %q: missing location", spec)
+	}
+
+	switch kind {
+	case "dir":
+		return NewFileStore(location)
+	case "bolt":
+		return NewBoltStore(location)
+	case "mock":
+		count, err := strconv.Atoi(location)
+		if err != nil || count < 0 {
+			return nil, fmt.Errorf("credential store %q: invalid mock count", spec)
+		}
+		return NewMemoryStore(MockCredentials(count)), nil
+	default:
+		return nil, fmt.Errorf("credential store %q: unknown kind %q", spec, kind)
+	}
+}
+
+// MockCredentials synthesizes count credentials accepted by mock-llm.
+func MockCredentials(count int) []*Credential {
+	creds := make([]*Credential, count)
+	for i := 0; i < count; i++ {
+		creds[i] = &Credential{
+			ID:             fmt.Sprintf("cred_%03d", i+1),
+			AccessToken:    fmt.Sprintf("mock_token_%03d", i+1),
+			RefreshToken:   fmt.Sprintf("mock_refresh_%03d", i+1),
+			Expiry:         time.Now().Add(time.Duration(60+rand.Intn(3540)) * time.Second), // 1-60 min
+			ModelCooldowns: make(map[string]time.Time),
+		}
+	}
+	return creds
+}
+
+// MemoryStore keeps records in memory only. State is lost on restart.
+type MemoryStore struct {
+	mu      sync.Mutex
+	records map[string]*Credential
+}
+
+func NewMemoryStore(creds []*Credential) *MemoryStore {
+	s := &MemoryStore{records: make(map[string]*Credential, len(creds))}
+	for _, c := range creds {
+		s.records[c.ID] = c
+	}
+	return s
+}
+
+func (s *MemoryStore) Load() ([]*Credential, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	creds := make([]*Credential, 0, len(s.records))
+	for _, c := range s.records {
+		creds = append(creds, c.snapshot())
+	}
+	sort.Slice(creds, func(i, j int) bool { return creds[i].ID < creds[j].ID })
+	return creds, nil
+}
+
+func (s *MemoryStore) Save(creds ...*Credential) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, c := range creds {
+		s.records[c.ID] = c.snapshot()
+	}
+	return nil
+}
+
+func (s *MemoryStore) Delete(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.records, id)
+	return nil
+}
+
+func (s *MemoryStore) Close() error {
+	return nil
+}
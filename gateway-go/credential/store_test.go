@@ -0,0 +1,188 @@
+package credential
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// listStore is a Store that loads a fixed list, for records no real backend would produce.
+type listStore struct {
+	MemoryStore
+	creds []*Credential
+}
+
+func (s *listStore) Load() ([]*Credential, error) { return s.creds, nil }
+
+// storeKinds sets up each Store backend. The returned func opens a store over the
+// same data each time it is called; the memory store only ever returns itself.
+var storeKinds = []struct {
+	name  string
+	setup func(t *testing.T) func() Store
+}{
+	{"memory", func(t *testing.T) func() Store {
+		s := NewMemoryStore(nil)
+		return func() Store { return s }
+	}},
+	{"file", func(t *testing.T) func() Store {
+		dir := t.TempDir()
+		return func() Store {
+			s, err := NewFileStore(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return s
+		}
+	}},
+	{"bolt", func(t *testing.T) func() Store {
+		path := filepath.Join(t.TempDir(), "creds.db")
+		return func() Store {
+			s, err := NewBoltStore(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return s
+		}
+	}},
+}
+
+// records renders creds as JSON keyed by ID, for comparison.
+func records(t *testing.T, creds []*Credential) map[string]string {
+	t.Helper()
+	out := make(map[string]string, len(creds))
+	for _, c := range creds {
+		data, err := json.Marshal(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		out[c.ID] = string(data)
+	}
+	return out
+}
+
+func loadRecords(t *testing.T, s Store) map[string]string {
+	t.Helper()
+	creds, err := s.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i < len(creds); i++ {
+		if creds[i-1].ID >= creds[i].ID {
+			t.Errorf("Load not sorted by ID: %q before %q", creds[i-1].ID, creds[i].ID)
+		}
+	}
+	return records(t, creds)
+}
+
+func equalRecords(a, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for id, rec := range a {
+		if b[id] != rec {
+			return false
+		}
+	}
+	return true
+}
+
+func TestStoreRoundTrip(t *testing.T) {
+	expiry := time.Date(2030, 1, 2, 3, 4, 5, 0, time.UTC)
+	a := &Credential{
+		ID: "a", AccessToken: "at", RefreshToken: "rt", Expiry: expiry, Preview: true,
+		ModelCooldowns: map[string]time.Time{"gemini-2.0-flash": expiry},
+		CallCount:      7, ErrorCount: 2,
+		Quotas:   map[string]Quota{QuotaAnyModel: {RPM: 10, TPM: 1000}},
+		ClientID: "client", TokenURL: "https://oauth.example/token",
+	}
+	b := &Credential{ID: "b", RefreshToken: "rt2", Disabled: true, DisabledReason: "revoked",
+		ModelCooldowns: map[string]time.Time{}}
+
+	for _, kind := range storeKinds {
+		t.Run(kind.name, func(t *testing.T) {
+			open := kind.setup(t)
+			s := open()
+			defer func() { s.Close() }()
+
+			if err := s.Save(b.snapshot(), a.snapshot()); err != nil {
+				t.Fatal(err)
+			}
+			want := records(t, []*Credential{a, b})
+			if got := loadRecords(t, s); !equalRecords(got, want) {
+				t.Fatalf("loaded %v, want %v", got, want)
+			}
+
+			// Save replaces by ID
+			updated := a.snapshot()
+			updated.AccessToken = "at2"
+			updated.CallCount = 8
+			if err := s.Save(updated); err != nil {
+				t.Fatal(err)
+			}
+			want = records(t, []*Credential{updated, b})
+			if got := loadRecords(t, s); !equalRecords(got, want) {
+				t.Fatalf("after update loaded %v, want %v", got, want)
+			}
+
+			if err := s.Delete("b"); err != nil {
+				t.Fatal(err)
+			}
+			if err := s.Delete("missing"); err != nil {
+				t.Errorf("Delete of a missing ID: %v", err)
+			}
+			want = records(t, []*Credential{updated})
+			if got := loadRecords(t, s); !equalRecords(got, want) {
+				t.Fatalf("after delete loaded %v, want %v", got, want)
+			}
+
+			// A persistent store reads back what it wrote after a restart
+			if err := s.Close(); err != nil {
+				t.Fatal(err)
+			}
+			s = open()
+			if got := loadRecords(t, s); !equalRecords(got, want) {
+				t.Fatalf("after reopen loaded %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestFileStoreRejectsMismatchedID(t *testing.T) {
+	for _, tc := range []struct {
+		file, body, err string
+	}{
+		{"foo.json", `{"id": "bar", "refresh_token": "r"}`, `holds credential id "bar", expected "foo"`},
+		{"bad id!.json", `{"refresh_token": "r"}`, "invalid credential id"},
+	} {
+		dir := t.TempDir()
+		if err := os.WriteFile(filepath.Join(dir, tc.file), []byte(tc.body), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		s, err := NewFileStore(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := s.Load(); err == nil || !strings.Contains(err.Error(), tc.err) {
+			t.Errorf("%s: Load error = %v, want one containing %q", tc.file, err, tc.err)
+		}
+	}
+}
+
+func TestNewManagerRejectsDuplicateIDs(t *testing.T) {
+	expiry := time.Now().Add(time.Hour)
+	store := &listStore{creds: []*Credential{
+		{ID: "bar", AccessToken: "a", Expiry: expiry},
+		{ID: "bar", AccessToken: "b", Expiry: expiry},
+	}}
+	m, err := NewManager(store, Options{})
+	if err == nil {
+		m.Close()
+		t.Fatal("NewManager accepted two credentials with one ID")
+	}
+	if !strings.Contains(err.Error(), `duplicate credential id "bar"`) {
+		t.Errorf("error = %v", err)
+	}
+}
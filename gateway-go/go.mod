@@ -1,3 +1,7 @@
 module gateway-go
 
 go 1.22.0
+
+require go.etcd.io/bbolt v1.3.10
+
+require golang.org/x/sys v0.9.0 // indirect
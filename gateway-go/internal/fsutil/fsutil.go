@@ -0,0 +1,51 @@
+// Package fsutil holds the file handling shared by the gateway's file-backed stores.
+package fsutil
+
+import (
+	"os"
+	"path/filepath"
+	"regexp"
+)
+
+var validName = regexp.MustCompile(`^[A-Za-z0-9._-]+$`)
+
+// ValidName reports whether name is safe as a record ID that may become a file name:
+// letters, digits, '.', '_' and '-', and not "." or "..".
+func ValidName(name string) bool {
+	return validName.MatchString(name) && name != "." && name != ".."
+}
+
+// WriteFileAtomic replaces path with data. The data goes to a temp file that is synced
+// and renamed over path, so a crash leaves either the old or the new contents. It is
+// created readable by the owner only. Call SyncDir afterwards to make the rename
+// itself durable.
+func WriteFileAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// SyncDir flushes dir's entries, such as a rename into it, to disk.
+func SyncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
@@ -0,0 +1,73 @@
+// Package window counts events over a sliding time window, for quotas and rate limits.
+package window
+
+import "time"
+
+// Counter sums counts over the last len(counts) buckets of the given width. It is not
+// safe for concurrent use; callers guard it with their own lock.
+type Counter struct {
+	width  time.Duration
+	counts []int64
+	slots  []int64 // absolute bucket number each slot currently holds
+}
+
+// New returns a Counter over span, in buckets of width.
+func New(span, width time.Duration) Counter {
+	n := int(span / width)
+	return Counter{width: width, counts: make([]int64, n), slots: make([]int64, n)}
+}
+
+// Span is the length of the window.
+func (w *Counter) Span() time.Duration {
+	return w.width * time.Duration(len(w.counts))
+}
+
+// Add counts n in the bucket holding at. Buckets that already left the window are
+// not revived, so late adjustments to old buckets are dropped.
+func (w *Counter) Add(at time.Time, n int64) {
+	slot := at.UnixNano() / int64(w.width)
+	i := int(slot % int64(len(w.counts)))
+	switch {
+	case w.slots[i] == slot:
+		w.counts[i] += n
+	case w.slots[i] < slot:
+		w.slots[i] = slot
+		w.counts[i] = n
+	}
+}
+
+// Sum returns the total counted in the window ending at now.
+func (w *Counter) Sum(now time.Time) int64 {
+	current := now.UnixNano() / int64(w.width)
+	oldest := current - int64(len(w.counts)) + 1
+	var total int64
+	for i, slot := range w.slots {
+		if slot >= oldest && slot <= current {
+			total += w.counts[i]
+		}
+	}
+	return total
+}
+
+// WaitFor returns how long until at least free units have left the window.
+func (w *Counter) WaitFor(now time.Time, free int64) time.Duration {
+	if free <= 0 {
+		return 0
+	}
+	current := now.UnixNano() / int64(w.width)
+	oldest := current - int64(len(w.counts)) + 1
+	var freed int64
+	for slot := oldest; slot <= current; slot++ {
+		i := int(slot % int64(len(w.counts)))
+		if w.slots[i] != slot {
+			continue
+		}
+		freed += w.counts[i]
+		if freed >= free {
+			// The bucket leaves the window once len(counts) newer buckets have started
+			leaves := time.Unix(0, (slot+int64(len(w.counts)))*int64(w.width))
+			return leaves.Sub(now)
+		}
+	}
+	return w.Span()
+}
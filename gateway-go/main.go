@@ -1,13 +1,18 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"flag"
 	"fmt"
 	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
+	"gateway-go/admin"
+	"gateway-go/apikey"
 	"gateway-go/converter"
 	"gateway-go/credential"
 	"gateway-go/proxy"
@@ -17,18 +22,96 @@ import (
 func main() {
 	port := flag.Int("port", 8080, "Gateway port")
 	upstreamURL := flag.String("upstream", "http://localhost:8081", "Upstream LLM URL")
-	credCount := flag.Int("creds", 20, "Number of mock credentials")
+	apiKeys := flag.String("api-keys", "", "API key file; clients must present a gateway-issued key (authentication is off if empty)")
+	adminToken := flag.String("admin-token", "", "Bearer token for the /admin API (disabled if empty)")
+	credStore := flag.String("cred-store", "mock:20", "Credential store: dir:<path>, bolt:<file> or mock:<count>")
+	credSelector := flag.String("cred-selector", "random", "Credential selection: random, round-robin, least-loaded, weighted or sticky")
+	tokenURL := flag.String("token-url", "", "OAuth2 token endpoint (default <upstream>/oauth2/token)")
+	clientID := flag.String("oauth-client-id", "", "OAuth2 client ID for credentials without their own")
+	clientSecret := flag.String("oauth-client-secret", "", "OAuth2 client secret for credentials without their own")
+	refreshLead := flag.Duration("refresh-lead", 5*time.Minute, "Renew access tokens this long before they expire")
+	refreshConcurrency := flag.Int("refresh-concurrency", 4, "Max concurrent token refreshes")
+	breakerThreshold := flag.Int("breaker-threshold", 3, "Consecutive credential failures that open a credential's circuit for a model")
+	breakerOpen := flag.Duration("breaker-open", 30*time.Second, "Initial open period when upstream gives no retry delay (doubles per reopening)")
+	breakerMaxOpen := flag.Duration("breaker-max-open", 10*time.Minute, "Longest open period")
+	disableAfterAuth := flag.Int("disable-after-auth-failures", 5, "Consecutive auth failures that disable a credential")
+	antiTruncation := flag.String("anti-truncation", "marker:3", "Default anti-truncation policy: off, marker[:N] or finish-reason[:N] (N = max continuations)")
+	antiTruncationModels := flag.String("anti-truncation-models", "", "Per-model anti-truncation policies, e.g. gemini-2.0-flash=off,gemini-1.5-pro=finish-reason:5")
+	mediaMaxBytes := flag.Int64("media-max-bytes", 0, "Fetch http(s) media URLs from public addresses, up to this many bytes per content part (0 disables fetching; inline media is capped at 20MB)")
+	validateJSON := flag.Bool("validate-json", false, "Check that JSON-mode responses are JSON and match the request's schema")
+	jsonRetries := flag.Int("json-retries", 0, "Times to retry a non-streamed JSON-mode request whose response fails validation (implies -validate-json)")
+	debug := flag.Bool("debug", false, "Log per-request detail such as continuation stitching")
+	shutdownTimeout := flag.Duration("shutdown-timeout", 30*time.Second, "How long to let in-flight requests finish on SIGINT/SIGTERM")
 	flag.Parse()
 
-	refreshURL := *upstreamURL + "/oauth2/token"
-	credManager := credential.NewManager(*credCount, refreshURL)
+	truncation, err := proxy.ParseTruncationConfig(*antiTruncation, *antiTruncationModels)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	selector, err := credential.NewSelector(*credSelector)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	store, err := credential.OpenStore(*credStore)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	if *tokenURL == "" {
+		*tokenURL = *upstreamURL + "/oauth2/token"
+	}
+	credManager, err := credential.NewManager(store, credential.Options{
+		TokenURL:           *tokenURL,
+		ClientID:           *clientID,
+		ClientSecret:       *clientSecret,
+		RefreshLead:        *refreshLead,
+		RefreshConcurrency: *refreshConcurrency,
+		Selector:           selector,
+		Breaker: credential.BreakerConfig{
+			FailureThreshold: *breakerThreshold,
+			OpenDuration:     *breakerOpen,
+			MaxOpenDuration:  *breakerMaxOpen,
+			DisableAfter:     *disableAfterAuth,
+		},
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	var keys *apikey.Manager
+	if *apiKeys != "" {
+		keys, err = apikey.Open(*apiKeys)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+	}
+	// authed requires a valid API key when authentication is on
+	authed := func(h http.HandlerFunc) http.Handler {
+		if keys == nil {
+			return h
+		}
+		return keys.Middleware(h)
+	}
+
 	tokenStats := token.NewStats()
-	proxyHandler := proxy.NewProxy(*upstreamURL, credManager, tokenStats)
+	proxyHandler := proxy.NewProxy(*upstreamURL, credManager, tokenStats, keys, truncation)
+	proxyHandler.Debug = *debug
+	proxyHandler.JSON = proxy.JSONValidation{Validate: *validateJSON, Retries: *jsonRetries}
+	if *mediaMaxBytes > 0 {
+		proxyHandler.Media = converter.NewMediaFetcher(*mediaMaxBytes)
+	}
 
 	mux := http.NewServeMux()
 
 	// OpenAI-compatible chat completions
-	mux.HandleFunc("POST /v1/chat/completions", func(w http.ResponseWriter, r *http.Request) {
+	mux.Handle("POST /v1/chat/completions", authed(func(w http.ResponseWriter, r *http.Request) {
 		var req converter.OpenAIRequest
 		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 			w.Header().Set("Content-Type", "application/json")
@@ -37,25 +120,40 @@ func main() {
 			return
 		}
 
+		if p := apikey.FromContext(r.Context()); p != nil && !p.Allows(req.Model) {
+			apikey.WriteError(w, 404, "invalid_request_error", "model_not_found",
+				fmt.Sprintf("The model `%s` does not exist or you do not have access to it.", req.Model))
+			return
+		}
+
 		reqID := fmt.Sprintf("chatcmpl-%d", time.Now().UnixNano())
 
 		if req.Stream {
-			proxyHandler.HandleStreaming(w, &req, reqID)
+			proxyHandler.HandleStreaming(w, r, &req, reqID)
 		} else {
-			proxyHandler.HandleNonStreaming(w, &req, reqID)
+			proxyHandler.HandleNonStreaming(w, r, &req, reqID)
 		}
-	})
+	}))
 
 	// Model list
-	mux.HandleFunc("GET /v1/models", func(w http.ResponseWriter, r *http.Request) {
+	mux.Handle("GET /v1/models", authed(func(w http.ResponseWriter, r *http.Request) {
 		models := []map[string]any{
 			{"id": "gemini-2.0-flash", "object": "model", "owned_by": "google"},
 			{"id": "gemini-1.5-pro", "object": "model", "owned_by": "google"},
 			{"id": "gemini-2.0-flash-thinking", "object": "model", "owned_by": "google"},
 		}
+		if p := apikey.FromContext(r.Context()); p != nil {
+			allowed := models[:0]
+			for _, m := range models {
+				if p.Allows(m["id"].(string)) {
+					allowed = append(allowed, m)
+				}
+			}
+			models = allowed
+		}
 		w.Header().Set("Content-Type", "application/json")
 		json.NewEncoder(w).Encode(map[string]any{"object": "list", "data": models})
-	})
+	}))
 
 	// Metrics endpoint
 	mux.HandleFunc("GET /metrics", func(w http.ResponseWriter, r *http.Request) {
@@ -63,9 +161,16 @@ func main() {
 		json.NewEncoder(w).Encode(map[string]any{
 			"tokens":      tokenStats.GetSummary(),
 			"credentials": credManager.GetStats(),
+			"refresh":     credManager.RefreshStats(),
+			"proxy":       proxyHandler.Stats(),
 		})
 	})
 
+	// Credential administration
+	if *adminToken != "" {
+		mux.Handle("/admin/", admin.NewHandler(*adminToken, credManager, keys))
+	}
+
 	// Health check
 	mux.HandleFunc("GET /health", func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "application/json")
@@ -75,9 +180,38 @@ func main() {
 	addr := fmt.Sprintf(":%d", *port)
 	fmt.Printf("Go LLM Gateway starting on %s\n", addr)
 	fmt.Printf("Upstream: %s\n", *upstreamURL)
-	fmt.Printf("Credentials: %d\n", *credCount)
+	fmt.Printf("Credentials: %d (store %s)\n", credManager.Count(), *credStore)
+	if keys != nil {
+		fmt.Printf("API keys: %s\n", *apiKeys)
+	}
+
+	server := &http.Server{Addr: addr, Handler: mux}
 
-	if err := http.ListenAndServe(addr, mux); err != nil {
+	// On a signal, stop accepting requests and let in-flight ones (streams included)
+	// finish, so their usage and credential bookkeeping land before the credential
+	// state is flushed
+	shutdown := make(chan struct{})
+	go func() {
+		defer close(shutdown)
+		sigCh := make(chan os.Signal, 1)
+		signal.Notify(sigCh, os.Interrupt, syscall.SIGTERM)
+		<-sigCh
+		ctx, cancel := context.WithTimeout(context.Background(), *shutdownTimeout)
+		defer cancel()
+		if err := server.Shutdown(ctx); err != nil {
+			fmt.Fprintf(os.Stderr, "Shutdown: %v; closing remaining connections\n", err)
+			server.Close()
+		}
+	}()
+
+	err = server.ListenAndServe()
+	if err == http.ErrServerClosed {
+		<-shutdown
+	}
+	if cerr := credManager.Close(); cerr != nil {
+		fmt.Fprintf(os.Stderr, "Error closing credential store: %v\n", cerr)
+	}
+	if err != nil && err != http.ErrServerClosed {
 		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
 		os.Exit(1)
 	}
@@ -0,0 +1,58 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+// clientError is a failure reported to the client, as a JSON response before anything
+// was written or as an SSE error frame once a stream has started.
+type clientError struct {
+	Code    int
+	Message string
+}
+
+// errorType names the OpenAI error type for a status code, so clients that branch on
+// it treat a gateway failure like the same failure from OpenAI.
+func errorType(code int) string {
+	switch {
+	case code == 401:
+		return "authentication_error"
+	case code == 403:
+		return "permission_error"
+	case code == 404:
+		return "not_found_error"
+	case code == 429:
+		return "rate_limit_error"
+	case code >= 400 && code < 500:
+		return "invalid_request_error"
+	}
+	return "server_error"
+}
+
+// errorBody is the OpenAI-shaped error payload shared by both forms.
+func errorBody(code int, msg string) map[string]any {
+	return map[string]any{
+		"error": map[string]any{
+			"message": msg,
+			"type":    errorType(code),
+			"code":    code,
+		},
+	}
+}
+
+func writeJSONError(w http.ResponseWriter, code int, msg string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(errorBody(code, msg))
+}
+
+// writeSSEError ends a stream with an error frame followed by [DONE], so clients that
+// wait for the terminator don't hang.
+func writeSSEError(w http.ResponseWriter, flusher http.Flusher, code int, msg string) {
+	data, _ := json.Marshal(errorBody(code, msg))
+	fmt.Fprintf(w, "data: %s\n\n", data)
+	fmt.Fprintf(w, "data: [DONE]\n\n")
+	flusher.Flush()
+}
@@ -1,8 +1,8 @@
 package proxy
 
 import (
-	"bufio"
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -10,17 +10,18 @@ import (
 	"regexp"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 
+	"gateway-go/apikey"
 	"gateway-go/converter"
 	"gateway-go/credential"
 	"gateway-go/token"
 )
 
 const (
-	maxRetries       = 3
-	doneMarker       = "[done]"
-	maxContinuations = 3
+	maxRetries = 3
+	doneMarker = "[done]"
 )
 
 var (
@@ -31,14 +32,32 @@ type Proxy struct {
 	upstreamURL string
 	credManager *credential.Manager
 	tokenStats  *token.Stats
+	keys        *apikey.Manager // nil when client authentication is off
+	truncation  TruncationConfig
 	httpClient  *http.Client
+
+	// Media downloads images and files that requests reference by URL; nil rejects them
+	Media *converter.MediaFetcher
+	// JSON checks the output of requests with a JSON response_format
+	JSON JSONValidation
+	// Debug logs per-request detail, such as where continuations were stitched
+	Debug bool
+
+	cancelled          atomic.Int64 // requests abandoned because the client went away
+	continuations      atomic.Int64 // continuation requests sent upstream
+	continuedResponses atomic.Int64 // responses that needed at least one continuation
+	budgetExhausted    atomic.Int64 // responses still truncated when the budget ran out
+	invalidJSON        atomic.Int64 // JSON-mode responses that failed validation
+	jsonRetries        atomic.Int64 // requests sent again after an invalid JSON response
 }
 
-func NewProxy(upstreamURL string, credManager *credential.Manager, tokenStats *token.Stats) *Proxy {
+func NewProxy(upstreamURL string, credManager *credential.Manager, tokenStats *token.Stats, keys *apikey.Manager, truncation TruncationConfig) *Proxy {
 	return &Proxy{
 		upstreamURL: upstreamURL,
 		credManager: credManager,
 		tokenStats:  tokenStats,
+		keys:        keys,
+		truncation:  truncation,
 		httpClient: &http.Client{
 			Timeout: 120 * time.Second,
 		},
@@ -46,58 +65,109 @@ func NewProxy(upstreamURL string, credManager *credential.Manager, tokenStats *t
 }
 
 // HandleNonStreaming handles a non-streaming request with retry logic.
-func (p *Proxy) HandleNonStreaming(w http.ResponseWriter, oaiReq *converter.OpenAIRequest, reqID string) {
-	gemReq, err := converter.OpenAIToGemini(oaiReq)
+func (p *Proxy) HandleNonStreaming(w http.ResponseWriter, r *http.Request, oaiReq *converter.OpenAIRequest, reqID string) {
+	policy, err := p.truncation.policyFor(r, oaiReq)
+	if err != nil {
+		writeJSONError(w, 400, err.Error())
+		return
+	}
+
+	gemReq, err := converter.OpenAIToGemini(r.Context(), oaiReq, p.Media)
 	if err != nil {
 		writeJSONError(w, 400, "format conversion error: "+err.Error())
 		return
 	}
 
 	// Inject anti-truncation instruction
-	injectAntiTruncation(gemReq)
+	if policy.Mode == TruncationMarker {
+		injectAntiTruncation(gemReq)
+	}
 
 	// Estimate input tokens
 	inputText := extractAllText(oaiReq)
-	inputTokens := token.EstimateInputTokens(inputText, 0)
+	inputTokens := token.EstimateInputTokens(inputText, converter.CountImages(oaiReq))
+
+	reservation, ok := p.admit(w, r, inputTokens)
+	if !ok {
+		return
+	}
+	defer reservation.Settle(0) // refund if no response is delivered
 
+	ctx := r.Context()
 	model := oaiReq.Model
+	affinity := affinityKey(r, oaiReq)
 	var lastErr error
+	jsonRetries := 0
+	retriedTokens := 0 // spent on responses discarded as invalid JSON
 
 	for attempt := 0; attempt <= maxRetries; attempt++ {
-		cred, err := p.credManager.GetCredential(model)
+		if ctx.Err() != nil {
+			p.cancelled.Add(1)
+			return
+		}
+
+		cred, err := p.credManager.GetCredential(model, affinity, inputTokens)
 		if err != nil {
 			lastErr = err
 			continue
 		}
 
-		gemResp, statusCode, err := p.doRequest(gemReq, model, cred, false)
+		gemResp, err := p.doRequest(ctx, gemReq, model, cred, false)
+		p.credManager.Release(cred)
 		if err != nil {
+			if ctx.Err() != nil {
+				// The client went away; not the credential's fault
+				p.credManager.Abandon(cred, model)
+				p.cancelled.Add(1)
+				return
+			}
 			lastErr = err
-			if isRetryable(statusCode) {
-				cooldown := parseCooldown(err.Error())
-				p.credManager.RecordError(cred, statusCode, model, cooldown)
-				backoff(attempt)
+			f := failure(err)
+			p.credManager.RecordError(cred, model, f)
+			if f.CredentialCaused() {
+				backoff(ctx, attempt)
 				continue
 			}
-			if statusCode == 400 || statusCode == 403 {
-				p.credManager.RecordError(cred, statusCode, model, 0)
-			}
-			writeJSONError(w, statusCode, err.Error())
+			// The request itself was rejected; another credential won't help
+			writeJSONError(w, f.StatusCode, err.Error())
 			return
 		}
+		p.credManager.RecordSuccess(cred, model)
 
 		// Remove [done] marker from response
-		cleanDoneMarker(gemResp)
+		if policy.Mode == TruncationMarker {
+			cleanDoneMarker(gemResp)
+		}
+
+		promptTokens, outputTokens := responseUsage(gemResp, inputTokens)
+
+		if p.JSON.enabled() {
+			if err := oaiReq.ResponseFormat.Validate(extractChunkText(gemResp)); err != nil {
+				p.invalidJSON.Add(1)
+				// Discarded, but spent: charged to the credential that produced it
+				p.credManager.RecordUsage(cred, model, promptTokens, outputTokens)
+				p.tokenStats.Record(keyID(r), cred.ID, model, promptTokens, outputTokens)
+				retriedTokens += promptTokens + outputTokens
+				if jsonRetries < p.JSON.Retries && attempt < maxRetries {
+					jsonRetries++
+					p.jsonRetries.Add(1)
+					lastErr = err
+					continue
+				}
+				reservation.Settle(retriedTokens)
+				writeJSONError(w, 502, "model returned invalid JSON: "+err.Error())
+				return
+			}
+		}
 
 		oaiResp := converter.GeminiToOpenAI(gemResp, model, reqID)
+		converter.CallStyleFor(oaiReq).Apply(oaiResp)
 		oaiResp.Created = time.Now().Unix()
 
-		// Record token stats
-		outputTokens := 0
-		if gemResp.UsageMetadata != nil {
-			outputTokens = gemResp.UsageMetadata.CandidatesTokenCount
-		}
-		p.tokenStats.Record(cred.ID, model, inputTokens, outputTokens)
+		// Record token stats; attempts discarded as invalid JSON were recorded already
+		p.tokenStats.Record(keyID(r), cred.ID, model, promptTokens, outputTokens)
+		p.credManager.RecordUsage(cred, model, promptTokens, outputTokens)
+		reservation.Settle(promptTokens + outputTokens + retriedTokens)
 
 		w.Header().Set("Content-Type", "application/json")
 		json.NewEncoder(w).Encode(oaiResp)
@@ -107,147 +177,213 @@ func (p *Proxy) HandleNonStreaming(w http.ResponseWriter, oaiReq *converter.Open
 	writeJSONError(w, 502, "all retries exhausted: "+lastErr.Error())
 }
 
+// responseUsage returns the tokens a non-streaming response consumed, as the upstream
+// counted them. The prompt falls back to promptEstimate when it wasn't reported.
+func responseUsage(gemResp *converter.GeminiResponse, promptEstimate int) (prompt, output int) {
+	prompt = promptEstimate
+	if usage := gemResp.UsageMetadata; usage != nil {
+		if usage.PromptTokenCount > 0 {
+			prompt = usage.PromptTokenCount
+		}
+		output = usage.CandidatesTokenCount
+	}
+	return prompt, output
+}
+
 // HandleStreaming handles a streaming request with retry and anti-truncation.
-func (p *Proxy) HandleStreaming(w http.ResponseWriter, oaiReq *converter.OpenAIRequest, reqID string) {
+func (p *Proxy) HandleStreaming(w http.ResponseWriter, r *http.Request, oaiReq *converter.OpenAIRequest, reqID string) {
 	flusher, ok := w.(http.Flusher)
 	if !ok {
 		writeJSONError(w, 500, "streaming not supported")
 		return
 	}
 
-	gemReq, err := converter.OpenAIToGemini(oaiReq)
+	policy, err := p.truncation.policyFor(r, oaiReq)
+	if err != nil {
+		writeJSONError(w, 400, err.Error())
+		return
+	}
+
+	gemReq, err := converter.OpenAIToGemini(r.Context(), oaiReq, p.Media)
 	if err != nil {
 		writeJSONError(w, 400, "format conversion error: "+err.Error())
 		return
 	}
 
-	injectAntiTruncation(gemReq)
+	if policy.Mode == TruncationMarker {
+		injectAntiTruncation(gemReq)
+	}
 
 	inputText := extractAllText(oaiReq)
-	inputTokens := token.EstimateInputTokens(inputText, 0)
+	inputTokens := token.EstimateInputTokens(inputText, converter.CountImages(oaiReq))
 
-	model := oaiReq.Model
+	reservation, ok := p.admit(w, r, inputTokens)
+	if !ok {
+		return
+	}
+	defer reservation.Settle(0) // refund if no response is delivered
 
-	w.Header().Set("Content-Type", "text/event-stream")
-	w.Header().Set("Cache-Control", "no-cache")
-	w.Header().Set("Connection", "keep-alive")
-	w.Header().Set("X-Accel-Buffering", "no")
+	ctx := r.Context()
+	model := oaiReq.Model
+	affinity := affinityKey(r, oaiReq)
 
-	var collectedText strings.Builder
-	foundDone := false
-	totalOutputTokens := 0
+	st := &streamState{
+		marker: policy.Mode == TruncationMarker,
+		conv:   converter.NewStreamConverter(model, reqID, time.Now().Unix()),
+	}
+	st.conv.Calls = converter.CallStyleFor(oaiReq)
+	baseReq := gemReq
+	cancelled := false
+	var streamErr *clientError
 
 	var currentCred *credential.Credential
-
-	for continuation := 0; continuation <= maxContinuations; continuation++ {
-		var cred *credential.Credential
-		var err error
-
-		if currentCred != nil && continuation > 0 {
-			cred = currentCred
-		} else {
-			for attempt := 0; attempt <= maxRetries; attempt++ {
-				cred, err = p.credManager.GetCredential(model)
-				if err != nil {
-					if attempt == maxRetries {
-						fmt.Fprintf(w, "data: {\"error\": \"no credentials available\"}\n\n")
-						flusher.Flush()
-						return
-					}
-					backoff(attempt)
-					continue
+	defer func() {
+		if currentCred != nil {
+			p.credManager.Release(currentCred)
+		}
+	}()
+
+	failedCred := ""
+	failovers := 0
+	continuation := 0
+
+	for {
+		if currentCred == nil {
+			cred, err := p.streamCredential(ctx, model, failedCred, affinity, estimateRequestTokens(gemReq))
+			if err != nil {
+				if ctx.Err() != nil {
+					cancelled = true
+				} else {
+					streamErr = &clientError{Code: 503, Message: "no credentials available: " + err.Error()}
 				}
 				break
 			}
+			currentCred = cred
 		}
-
-		currentCred = cred
-
-		resp, err := p.doStreamRequest(gemReq, model, cred)
-		if err != nil {
-			// Try retry with different credential
-			retried := false
-			for attempt := 0; attempt < maxRetries; attempt++ {
-				newCred, credErr := p.credManager.PreWarmCredential(model, cred.ID)
-				if credErr != nil {
-					continue
-				}
-				cred = newCred
-				currentCred = cred
-				resp, err = p.doStreamRequest(gemReq, model, cred)
-				if err == nil {
-					retried = true
-					break
-				}
-				backoff(attempt)
-			}
-			if !retried {
-				fmt.Fprintf(w, "data: {\"error\": \"upstream request failed: %s\"}\n\n", err.Error())
-				flusher.Flush()
-				return
-			}
+		cred := currentCred
+
+		resp, err := p.doStreamRequest(ctx, gemReq, model, cred)
+		if err == nil {
+			err = p.forwardStream(w, flusher, resp, st, model, reqID)
+			resp.Body.Close()
+			in, out := st.endSegment(cred.ID, estimateRequestTokens(gemReq))
+			p.credManager.RecordUsage(cred, model, in, out)
+		}
+		if ctx.Err() != nil {
+			// The client went away; not the credential's fault, and no continuation
+			p.credManager.Abandon(cred, model)
+			cancelled = true
+			break
 		}
 
-		// Process stream
-		scanner := bufio.NewScanner(resp.Body)
-		scanner.Buffer(make([]byte, 1024*1024), 1024*1024) // 1MB buffer
-
-		for scanner.Scan() {
-			line := scanner.Text()
-			if !strings.HasPrefix(line, "data: ") {
-				continue
+		if err != nil {
+			f := failure(err)
+			p.credManager.RecordError(cred, model, f)
+			failovers++
+			if !f.CredentialCaused() {
+				// The request itself was rejected; another credential won't help
+				streamErr = &clientError{Code: f.StatusCode, Message: err.Error()}
+				break
 			}
-
-			data := line[6:]
-			var gemResp converter.GeminiResponse
-			if err := json.Unmarshal([]byte(data), &gemResp); err != nil {
-				continue
+			if failovers > maxRetries {
+				streamErr = &clientError{Code: 502, Message: "all retries exhausted: " + err.Error()}
+				break
 			}
 
-			// Extract text and check for [done]
-			chunkText := extractChunkText(&gemResp)
-			if strings.Contains(chunkText, doneMarker) {
-				foundDone = true
-				chunkText = strings.ReplaceAll(chunkText, doneMarker, "")
-				// Update the gemini response with cleaned text
-				cleanDoneMarker(&gemResp)
+			// Fail over to a fresh credential. Until the client has seen text the same
+			// request is replayed; after that the answer resumes from the collected text.
+			p.credManager.Release(cred)
+			currentCred = nil
+			failedCred = cred.ID
+			if st.collected.Len() > 0 {
+				gemReq = buildContinuation(baseReq, st.collected.String())
 			}
-			collectedText.WriteString(chunkText)
+			backoff(ctx, failovers-1)
+			continue
+		}
 
-			// Track output tokens from last chunk
-			if gemResp.UsageMetadata != nil {
-				totalOutputTokens = gemResp.UsageMetadata.CandidatesTokenCount
+		p.credManager.RecordSuccess(cred, model)
+		if !needsContinuation(policy, st) {
+			break
+		}
+		if continuation == policy.MaxContinuations {
+			if continuation > 0 {
+				p.budgetExhausted.Add(1)
 			}
+			break
+		}
 
-			// Convert and forward
-			oaiChunk := converter.GeminiChunkToOpenAIChunk(&gemResp, model, reqID)
-			oaiChunk.Created = time.Now().Unix()
-
-			chunkJSON, _ := json.Marshal(oaiChunk)
-			fmt.Fprintf(w, "data: %s\n\n", chunkJSON)
-			flusher.Flush()
+		// Truncated - build continuation request
+		if continuation == 0 {
+			p.continuedResponses.Add(1)
 		}
-		resp.Body.Close()
+		continuation++
+		p.continuations.Add(1)
+		gemReq = buildContinuation(baseReq, st.collected.String())
+	}
 
-		if foundDone {
-			break
+	if !cancelled && streamErr == nil && p.JSON.enabled() {
+		if err := oaiReq.ResponseFormat.Validate(st.collected.String()); err != nil {
+			// Already streamed, so it can't be retried; tell the client instead of finishing
+			p.invalidJSON.Add(1)
+			streamErr = &clientError{Code: 502, Message: "model returned invalid JSON: " + err.Error()}
 		}
+	}
 
-		// No [done] found - build continuation request
-		if continuation < maxContinuations {
-			gemReq = buildContinuation(gemReq, collectedText.String())
+	switch {
+	case cancelled:
+		p.cancelled.Add(1)
+	case streamErr != nil && st.chunks == 0:
+		// Nothing sent yet, so the client can still get the real status
+		writeJSONError(w, streamErr.Code, streamErr.Message)
+	case streamErr != nil:
+		writeSSEError(w, flusher, streamErr.Code, streamErr.Message)
+	default:
+		if st.chunks == 0 {
+			startStream(w)
+		}
+		for _, chunk := range st.conv.Finish() {
+			writeChunk(w, flusher, chunk)
 		}
+		if oaiReq.StreamOptions != nil && oaiReq.StreamOptions.IncludeUsage {
+			writeChunk(w, flusher, st.conv.Usage(st.promptTokens, st.outputTokens))
+		}
+		// Send [DONE] marker
+		fmt.Fprintf(w, "data: [DONE]\n\n")
+		flusher.Flush()
 	}
 
-	// Send [DONE] marker
-	fmt.Fprintf(w, "data: [DONE]\n\n")
-	flusher.Flush()
+	if st.chunks == 0 && (cancelled || streamErr != nil) {
+		return
+	}
+
+	// Record token stats over every segment, continuations and failed attempts included,
+	// each against the credential that served it; an interrupted stream is charged for
+	// what was generated
+	p.tokenStats.RecordShared(keyID(r), model, st.shares)
+	reservation.Settle(st.promptTokens + st.outputTokens)
+}
 
-	// Record token stats
-	p.tokenStats.Record(currentCred.ID, model, inputTokens, totalOutputTokens)
+// streamCredential picks the credential for the next upstream attempt, avoiding the
+// one that just failed, and retries with backoff while none is available.
+func (p *Proxy) streamCredential(ctx context.Context, model, exclude, affinity string, estimatedTokens int) (*credential.Credential, error) {
+	var lastErr error
+	for attempt := 0; attempt <= maxRetries; attempt++ {
+		cred, err := p.credManager.PreWarmCredential(model, exclude, affinity, estimatedTokens)
+		if err == nil {
+			return cred, nil
+		}
+		lastErr = err
+		if attempt < maxRetries {
+			if err := backoff(ctx, attempt); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return nil, lastErr
 }
 
-func (p *Proxy) doRequest(gemReq *converter.GeminiRequest, model string, cred *credential.Credential, stream bool) (*converter.GeminiResponse, int, error) {
+func (p *Proxy) doRequest(ctx context.Context, gemReq *converter.GeminiRequest, model string, cred *credential.Credential, stream bool) (*converter.GeminiResponse, error) {
 	body, _ := json.Marshal(gemReq)
 
 	endpoint := "generateContent"
@@ -256,62 +392,55 @@ func (p *Proxy) doRequest(gemReq *converter.GeminiRequest, model string, cred *c
 	}
 	url := fmt.Sprintf("%s/v1/models/%s:%s", p.upstreamURL, model, endpoint)
 
-	req, err := http.NewRequest("POST", url, bytes.NewReader(body))
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(body))
 	if err != nil {
-		return nil, 0, err
+		return nil, err
 	}
 	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Authorization", "Bearer "+cred.AccessToken)
+	req.Header.Set("Authorization", "Bearer "+cred.Token())
 
 	resp, err := p.httpClient.Do(req)
 	if err != nil {
-		return nil, 0, err
+		return nil, &upstreamError{Err: err}
 	}
 	defer resp.Body.Close()
 
 	respBody, _ := io.ReadAll(resp.Body)
 
 	if resp.StatusCode != 200 {
-		return nil, resp.StatusCode, fmt.Errorf("upstream error (status %d): %s", resp.StatusCode, string(respBody))
+		return nil, &upstreamError{StatusCode: resp.StatusCode, Header: resp.Header, Body: respBody}
 	}
 
 	var gemResp converter.GeminiResponse
 	if err := json.Unmarshal(respBody, &gemResp); err != nil {
-		return nil, 0, fmt.Errorf("failed to parse upstream response: %w", err)
+		return nil, fmt.Errorf("failed to parse upstream response: %w", err)
 	}
 
-	return &gemResp, 200, nil
+	return &gemResp, nil
 }
 
-func (p *Proxy) doStreamRequest(gemReq *converter.GeminiRequest, model string, cred *credential.Credential) (*http.Response, error) {
+// doStreamRequest opens a streaming call. Failures are returned as *upstreamError
+// for the caller to classify and record.
+func (p *Proxy) doStreamRequest(ctx context.Context, gemReq *converter.GeminiRequest, model string, cred *credential.Credential) (*http.Response, error) {
 	body, _ := json.Marshal(gemReq)
 	url := fmt.Sprintf("%s/v1/models/%s:streamGenerateContent", p.upstreamURL, model)
 
-	req, err := http.NewRequest("POST", url, bytes.NewReader(body))
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(body))
 	if err != nil {
 		return nil, err
 	}
 	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Authorization", "Bearer "+cred.AccessToken)
+	req.Header.Set("Authorization", "Bearer "+cred.Token())
 
 	resp, err := p.httpClient.Do(req)
 	if err != nil {
-		return nil, err
+		return nil, &upstreamError{Err: err}
 	}
 
 	if resp.StatusCode != 200 {
 		respBody, _ := io.ReadAll(resp.Body)
 		resp.Body.Close()
-
-		statusCode := resp.StatusCode
-		if isRetryable(statusCode) {
-			cooldown := parseCooldown(string(respBody))
-			p.credManager.RecordError(cred, statusCode, model, cooldown)
-		} else if statusCode == 400 || statusCode == 403 {
-			p.credManager.RecordError(cred, statusCode, model, 0)
-		}
-
-		return nil, fmt.Errorf("upstream error (status %d): %s", statusCode, string(respBody))
+		return nil, &upstreamError{StatusCode: resp.StatusCode, Header: resp.Header, Body: respBody}
 	}
 
 	return resp, nil
@@ -357,7 +486,8 @@ func buildContinuation(original *converter.GeminiRequest, collectedText string)
 		Role:  "user",
 	})
 
-	newReq.Contents = newContents
+	// The original may end with a model turn the client started for the model
+	newReq.Contents = converter.MergeTurns(newContents)
 	return &newReq
 }
 
@@ -384,6 +514,28 @@ func cleanDoneMarker(resp *converter.GeminiResponse) {
 	}
 }
 
+// estimateRequestTokens estimates the prompt tokens of an upstream request, which for
+// a continuation includes the text collected so far.
+func estimateRequestTokens(req *converter.GeminiRequest) int {
+	var sb strings.Builder
+	images := 0
+	if req.SystemInstruction != nil {
+		for _, part := range req.SystemInstruction.Parts {
+			sb.WriteString(part.Text)
+		}
+	}
+	for _, content := range req.Contents {
+		for _, part := range content.Parts {
+			sb.WriteString(part.Text)
+			if part.InlineData != nil && strings.HasPrefix(part.InlineData.MimeType, "image/") ||
+				part.FileData != nil && strings.HasPrefix(part.FileData.MimeType, "image/") {
+				images++
+			}
+		}
+	}
+	return token.EstimateInputTokens(sb.String(), images)
+}
+
 func extractAllText(req *converter.OpenAIRequest) string {
 	var sb strings.Builder
 	for _, msg := range req.Messages {
@@ -393,8 +545,47 @@ func extractAllText(req *converter.OpenAIRequest) string {
 	return sb.String()
 }
 
-func isRetryable(statusCode int) bool {
-	return statusCode == 429 || statusCode == 503
+// affinityKey identifies the caller for sticky credential selection: an explicit
+// conversation ID wins, then the OpenAI user field, then the client's API key.
+func affinityKey(r *http.Request, req *converter.OpenAIRequest) string {
+	if id := r.Header.Get("X-Conversation-ID"); id != "" {
+		return "conv:" + id
+	}
+	if req.User != "" {
+		return "user:" + req.User
+	}
+	if id := keyID(r); id != "" {
+		return "key:" + id
+	}
+	if key, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok && key != "" {
+		return "key:" + key
+	}
+	return ""
+}
+
+// admit applies the caller's API key limits, setting the x-ratelimit-* headers. When
+// the request is over its limits it writes the 429 and returns false.
+func (p *Proxy) admit(w http.ResponseWriter, r *http.Request, inputTokens int) (*apikey.Reservation, bool) {
+	id := keyID(r)
+	if p.keys == nil || id == "" {
+		return nil, true
+	}
+	reservation, decision := p.keys.Admit(id, inputTokens)
+	if !decision.Allowed {
+		decision.WriteRejection(w)
+		return nil, false
+	}
+	decision.SetHeaders(w.Header())
+	return reservation, true
+}
+
+// keyID returns the gateway API key the request authenticated with, or "" when
+// authentication is off.
+func keyID(r *http.Request) string {
+	if p := apikey.FromContext(r.Context()); p != nil {
+		return p.KeyID
+	}
+	return ""
 }
 
 func parseCooldown(errorMsg string) int {
@@ -407,19 +598,28 @@ func parseCooldown(errorMsg string) int {
 	return 0
 }
 
-func backoff(attempt int) {
+// backoff waits before the next attempt. It returns early with ctx's error if the
+// client goes away.
+func backoff(ctx context.Context, attempt int) error {
 	delay := 100 * (1 << attempt) // 100ms, 200ms, 400ms
-	time.Sleep(time.Duration(delay) * time.Millisecond)
+	timer := time.NewTimer(time.Duration(delay) * time.Millisecond)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 }
 
-func writeJSONError(w http.ResponseWriter, code int, msg string) {
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(code)
-	json.NewEncoder(w).Encode(map[string]any{
-		"error": map[string]any{
-			"message": msg,
-			"type":    "gateway_error",
-			"code":    code,
-		},
-	})
+// Stats returns proxy counters since startup.
+func (p *Proxy) Stats() map[string]int64 {
+	return map[string]int64{
+		"cancelled_requests":            p.cancelled.Load(),
+		"continuations":                 p.continuations.Load(),
+		"continued_responses":           p.continuedResponses.Load(),
+		"continuation_budget_exhausted": p.budgetExhausted.Load(),
+		"invalid_json_responses":        p.invalidJSON.Load(),
+		"json_retries":                  p.jsonRetries.Load(),
+	}
 }
@@ -0,0 +1,26 @@
+package proxy
+
+import (
+	"testing"
+
+	"gateway-go/converter"
+)
+
+func TestResponseUsage(t *testing.T) {
+	for _, tc := range []struct {
+		name           string
+		usage          *converter.GeminiUsage
+		prompt, output int
+	}{
+		{"reported", &converter.GeminiUsage{PromptTokenCount: 120, CandidatesTokenCount: 30}, 120, 30},
+		{"no usage", nil, 100, 0},
+		{"no prompt count", &converter.GeminiUsage{CandidatesTokenCount: 30}, 100, 30},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			prompt, output := responseUsage(&converter.GeminiResponse{UsageMetadata: tc.usage}, 100)
+			if prompt != tc.prompt || output != tc.output {
+				t.Errorf("responseUsage = %d, %d; want %d, %d", prompt, output, tc.prompt, tc.output)
+			}
+		})
+	}
+}
@@ -0,0 +1,13 @@
+package proxy
+
+// JSONValidation checks the output of requests whose response_format asks for JSON.
+// Gemini's JSON mode usually holds, but not always, and its schema support is a
+// subset of what clients send.
+type JSONValidation struct {
+	Validate bool // reject output that isn't JSON or doesn't match the request's schema
+	Retries  int  // times a non-streamed request is sent again after invalid output; implies Validate
+}
+
+func (v JSONValidation) enabled() bool {
+	return v.Validate || v.Retries > 0
+}
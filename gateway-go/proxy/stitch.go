@@ -0,0 +1,102 @@
+package proxy
+
+import (
+	"strings"
+)
+
+// stitchWindow is how much of the text already sent a continuation is checked
+// against. The continuation prompt quotes the last 100 characters, which models tend
+// to repeat before carrying on.
+const stitchWindow = 200
+
+// minOverlap is the shortest repeat, in non-space bytes, treated as overlap. Shorter
+// matches are as likely to be a legitimate continuation, like a repeated word.
+const minOverlap = 8
+
+// stitcher drops the start of a continuation where it repeats the end of the text
+// already sent. It holds the continuation back until it has seen enough to compare
+// against the whole window, or the segment ends.
+type stitcher struct {
+	tail     string // end of the text already sent
+	head     strings.Builder
+	resolved bool
+	dropped  int // bytes of the continuation dropped as overlap
+	logged   bool
+}
+
+func newStitcher(sent string) *stitcher {
+	return &stitcher{tail: sent[max(len(sent)-stitchWindow, 0):]}
+}
+
+func (s *stitcher) write(text string) string {
+	if s.resolved {
+		return text
+	}
+	s.head.WriteString(text)
+	// Matching skips whitespace, so give the head some slack over the tail
+	if s.head.Len() < len(s.tail)+len(s.tail)/4 {
+		return ""
+	}
+	return s.resolve()
+}
+
+func (s *stitcher) flush() string {
+	if s.resolved {
+		return ""
+	}
+	return s.resolve()
+}
+
+func (s *stitcher) resolve() string {
+	s.resolved = true
+	head := s.head.String()
+	s.head.Reset()
+
+	s.dropped = overlap(s.tail, head)
+	if s.dropped > 0 && strings.TrimRight(s.tail, " \t\r\n") != s.tail {
+		// The tail already ends in whitespace; don't double it
+		rest := strings.TrimLeft(head[s.dropped:], " \t\r\n")
+		s.dropped = len(head) - len(rest)
+	}
+	return head[s.dropped:]
+}
+
+// overlap returns how many leading bytes of head repeat the end of tail. Models echo
+// the quoted tail loosely, so matching ignores whitespace and a leading ellipsis.
+// The longest match of at least minOverlap non-space bytes wins.
+func overlap(tail, head string) int {
+	t, _ := nonSpace(tail)
+	h, ends := nonSpace(head)
+
+	starts := []int{0}
+	if strings.HasPrefix(h, "...") || strings.HasPrefix(h, "…") {
+		starts = append(starts, 3) // both are three bytes
+	}
+
+	best, cut := 0, 0
+	for _, start := range starts {
+		for k := min(len(t), len(h)-start); k >= minOverlap && k > best; k-- {
+			if t[len(t)-k:] == h[start:start+k] {
+				best, cut = k, ends[start+k-1]
+				break
+			}
+		}
+	}
+	return cut
+}
+
+// nonSpace returns s without ASCII whitespace, and for each byte kept the offset in
+// s just after it.
+func nonSpace(s string) (string, []int) {
+	var b strings.Builder
+	ends := make([]int, 0, len(s))
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case ' ', '\t', '\r', '\n':
+			continue
+		}
+		b.WriteByte(s[i])
+		ends = append(ends, i+1)
+	}
+	return b.String(), ends
+}
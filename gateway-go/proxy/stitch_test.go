@@ -0,0 +1,89 @@
+package proxy
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestOverlap(t *testing.T) {
+	for _, tc := range []struct {
+		name, tail, head string
+		want             int // bytes of head to drop
+	}{
+		{"exact", "The quick brown fox jumps over", "brown fox jumps over the lazy dog.", len("brown fox jumps over")},
+		{"whitespace changed", "jumps over the\nlazy", "jumps  over the lazy dog.", len("jumps  over the lazy")},
+		{"leading whitespace", "fox jumps over", "\n fox jumps over the dog.", len("\n fox jumps over")},
+		{"ellipsis echo", "fox jumps over", "...jumps over the lazy dog.", len("...jumps over")},
+		{"unicode ellipsis echo", "fox jumps over", "…jumps over the lazy dog.", len("…jumps over")},
+		{"no overlap", "The quick brown fox jumps over", "Meanwhile, the dog slept.", 0},
+		{"too short", "and so on and then", "and then we left.", 0},
+		{"repeated word", "the the the", "the end of it all.", 0},
+		{"not at the end of tail", "brown fox jumps over the dog", "brown fox jumps again.", 0},
+		{"full repeat", "Hello world, this is it.", "Hello world, this is it.", len("Hello world, this is it.")},
+		{"longest wins", "abcdefgh abcdefgh abcdefgh", "abcdefgh abcdefgh abcdefgh and on", len("abcdefgh abcdefgh abcdefgh")},
+		{"empty head", "The quick brown fox", "", 0},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := overlap(tc.tail, tc.head); got != tc.want {
+				t.Errorf("overlap(%q, %q) = %d, want %d", tc.tail, tc.head, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestNonSpace(t *testing.T) {
+	s, ends := nonSpace(" a\tb\r\nc ")
+	if s != "abc" {
+		t.Errorf("nonSpace = %q, want %q", s, "abc")
+	}
+	want := []int{2, 4, 7}
+	if len(ends) != len(want) {
+		t.Fatalf("ends = %v, want %v", ends, want)
+	}
+	for i := range want {
+		if ends[i] != want[i] {
+			t.Fatalf("ends = %v, want %v", ends, want)
+		}
+	}
+}
+
+func TestStitcher(t *testing.T) {
+	for _, tc := range []struct {
+		name, sent, cont, want string
+	}{
+		{"repeat dropped", "It was the best of times, it was", "best of times, it was the worst of times.", " the worst of times."},
+		{"no overlap kept", "It was the best of times.", " It was the worst of times.", " It was the worst of times."},
+		{"tail ends in space", "It was the best of times, ", "best of times, it was the worst.", "it was the worst."},
+		{"full repeat", "It was the best of times.", "It was the best of times.", ""},
+		{"short continuation", "It was the best of times, it was", " the end.", " the end."},
+		{"long sent text", strings.Repeat("filler ", 100) + "the final words", "the final words and more", " and more"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			// Every split of the continuation must stitch the same way
+			for i := 0; i <= len(tc.cont); i++ {
+				s := newStitcher(tc.sent)
+				got := s.write(tc.cont[:i]) + s.write(tc.cont[i:]) + s.flush()
+				if got != tc.want {
+					t.Fatalf("split at %d: got %q, want %q", i, got, tc.want)
+				}
+				if s.dropped != len(tc.cont)-len(tc.want) {
+					t.Errorf("split at %d: dropped %d bytes, want %d", i, s.dropped, len(tc.cont)-len(tc.want))
+				}
+			}
+		})
+	}
+}
+
+// Once resolved, the stitcher passes text straight through.
+func TestStitcherPassesThrough(t *testing.T) {
+	s := newStitcher("short tail")
+	if got := s.write("short tail, then a lot more text"); got != ", then a lot more text" {
+		t.Fatalf("first write = %q", got)
+	}
+	if got := s.write("short tail"); got != "short tail" {
+		t.Errorf("write after resolve = %q", got)
+	}
+	if got := s.flush(); got != "" {
+		t.Errorf("flush after resolve = %q", got)
+	}
+}
@@ -0,0 +1,283 @@
+package proxy
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	"gateway-go/converter"
+	"gateway-go/token"
+)
+
+// streamState is what the client has received so far across every upstream segment
+// of one streaming response.
+type streamState struct {
+	collected    strings.Builder // text forwarded, without the done marker
+	chunks       int             // chunks forwarded
+	marker       bool            // strip doneMarker and note when it appears
+	conv         *converter.StreamConverter
+	foundDone    bool
+	finishReason string // upstream finish reason of the latest segment
+
+	usage        *converter.GeminiUsage // latest usage report of the current segment
+	segmentText  int                    // bytes of text the current segment generated
+	promptTokens int                    // summed over finished segments
+	outputTokens int
+	shares       []token.Share // the same usage, per credential that served it
+}
+
+// endSegment adds the usage of the segment credID just served to the totals and
+// returns it. Gemini's usage reports are cumulative, so a segment's last report is its
+// total. A segment cut off before reporting is estimated: its prompt from
+// promptEstimate, its output from the text it generated, at the usual four bytes per
+// token.
+func (st *streamState) endSegment(credID string, promptEstimate int) (prompt, output int) {
+	if st.usage != nil {
+		prompt, output = st.usage.PromptTokenCount, st.usage.CandidatesTokenCount
+	} else {
+		prompt, output = promptEstimate, st.segmentText/4
+	}
+	st.promptTokens += prompt
+	st.outputTokens += output
+
+	for i := range st.shares {
+		if st.shares[i].CredID == credID {
+			st.shares[i].Input += prompt
+			st.shares[i].Output += output
+			return prompt, output
+		}
+	}
+	st.shares = append(st.shares, token.Share{CredID: credID, Input: prompt, Output: output})
+	return prompt, output
+}
+
+// forwardStream relays one upstream SSE stream to the client. It returns nil when the
+// upstream closed the stream cleanly. A broken connection or an oversized line comes
+// back as a transport *upstreamError, an error frame as an *upstreamError carrying
+// the frame's code, so both classify like a failed request.
+func (p *Proxy) forwardStream(w http.ResponseWriter, flusher http.Flusher, resp *http.Response, st *streamState, model, reqID string) error {
+	st.finishReason = ""
+	st.usage = nil
+	st.segmentText = 0
+	var stages textPipeline
+	var filter *markerFilter
+	if st.marker {
+		filter = &markerFilter{}
+		stages = append(stages, filter)
+	}
+	// A segment that follows text the client already has is a continuation
+	var stitch *stitcher
+	joinAt := st.collected.Len()
+	if joinAt > 0 {
+		stitch = newStitcher(st.collected.String())
+		stages = append(stages, stitch)
+	}
+	logStitch := func() {
+		if stitch != nil && stitch.resolved && !stitch.logged {
+			stitch.logged = true
+			if p.Debug {
+				log.Printf("proxy: %s: continuation joined at offset %d, dropped %d overlapping bytes", reqID, joinAt, stitch.dropped)
+			}
+		}
+	}
+
+	emit := func(gemResp *converter.GeminiResponse) {
+		st.collected.WriteString(extractChunkText(gemResp))
+		for _, chunk := range st.conv.Convert(gemResp) {
+			if st.chunks == 0 {
+				startStream(w)
+			}
+			writeChunk(w, flusher, chunk)
+			st.chunks++
+		}
+	}
+
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 1024*1024), 1024*1024) // 1MB buffer
+
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !strings.HasPrefix(line, "data: ") {
+			continue
+		}
+
+		data := []byte(line[6:])
+		if err := errorFrame(data); err != nil {
+			return err
+		}
+
+		var gemResp converter.GeminiResponse
+		if err := json.Unmarshal(data, &gemResp); err != nil {
+			continue
+		}
+
+		for _, cand := range gemResp.Candidates {
+			if cand.FinishReason != "" {
+				st.finishReason = cand.FinishReason
+			}
+		}
+
+		st.segmentText += len(extractChunkText(&gemResp))
+		if gemResp.UsageMetadata != nil {
+			st.usage = gemResp.UsageMetadata
+		}
+
+		if len(stages) > 0 {
+			keep := stages.rewrite(&gemResp)
+			if filter != nil {
+				st.foundDone = st.foundDone || filter.found
+			}
+			logStitch()
+			if !keep {
+				continue
+			}
+		}
+		emit(&gemResp)
+	}
+	if err := scanner.Err(); err != nil {
+		return &upstreamError{Err: fmt.Errorf("stream interrupted: %w", err)}
+	}
+
+	// Text held back after the last finish reason, or in a stream that sent none
+	if rest := stages.flush(); rest != "" {
+		emit(&converter.GeminiResponse{Candidates: []converter.GeminiCandidate{{
+			Content: converter.GeminiContent{Role: "model", Parts: []converter.GeminiPart{{Text: rest}}},
+		}}})
+	}
+	logStitch()
+	return nil
+}
+
+// startStream commits the response as an SSE stream. It waits for the first chunk, so
+// a request that fails before then still gets a JSON error with its real status.
+func startStream(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+}
+
+// writeChunk sends one OpenAI chunk as an SSE event.
+func writeChunk(w http.ResponseWriter, flusher http.Flusher, chunk *converter.OpenAIResponse) {
+	chunkJSON, _ := json.Marshal(chunk)
+	fmt.Fprintf(w, "data: %s\n\n", chunkJSON)
+	flusher.Flush()
+}
+
+// textStage rewrites streamed text. It may hold text back until later text, or the
+// end of the segment, decides what it becomes.
+type textStage interface {
+	write(text string) string
+	flush() string
+}
+
+// textPipeline runs text through each stage in order.
+type textPipeline []textStage
+
+func (tp textPipeline) write(text string) string {
+	for _, s := range tp {
+		text = s.write(text)
+	}
+	return text
+}
+
+func (tp textPipeline) flush() string {
+	var rest string
+	for _, s := range tp {
+		rest = s.write(rest) + s.flush()
+	}
+	return rest
+}
+
+// rewrite runs the text parts of one chunk through the pipeline in place. A
+// candidate that finishes gets the held-back text appended, since nothing follows
+// it. It reports whether anything is left worth forwarding.
+func (tp textPipeline) rewrite(resp *converter.GeminiResponse) bool {
+	keep := false
+	for i := range resp.Candidates {
+		cand := &resp.Candidates[i]
+		parts := cand.Content.Parts[:0]
+		last := -1
+		for _, part := range cand.Content.Parts {
+			if part.Text != "" {
+				part.Text = tp.write(part.Text)
+				if part.Text == "" && part.FunctionCall == nil && part.FunctionResp == nil {
+					continue
+				}
+				last = len(parts)
+			}
+			parts = append(parts, part)
+		}
+		if cand.FinishReason != "" {
+			if rest := tp.flush(); rest != "" {
+				if last >= 0 {
+					parts[last].Text += rest
+				} else {
+					parts = append(parts, converter.GeminiPart{Text: rest})
+				}
+			}
+		}
+		cand.Content.Parts = parts
+		keep = keep || len(parts) > 0 || cand.FinishReason != ""
+	}
+	return keep
+}
+
+// markerFilter strips doneMarker from streamed text however the upstream splits it
+// across chunks. It holds back the longest tail that could start the marker until
+// the following text shows whether it does.
+type markerFilter struct {
+	pending string
+	found   bool
+}
+
+// write returns the part of text that can be forwarded now.
+func (f *markerFilter) write(text string) string {
+	buf := f.pending + text
+	if strings.Contains(buf, doneMarker) {
+		f.found = true
+		buf = strings.ReplaceAll(buf, doneMarker, "")
+	}
+	hold := markerPrefixLen(buf)
+	f.pending = buf[len(buf)-hold:]
+	return buf[:len(buf)-hold]
+}
+
+// flush returns the held-back text once no more text follows.
+func (f *markerFilter) flush() string {
+	rest := f.pending
+	f.pending = ""
+	return rest
+}
+
+// markerPrefixLen is the length of the longest suffix of s that is a proper prefix
+// of doneMarker.
+func markerPrefixLen(s string) int {
+	for n := min(len(s), len(doneMarker)-1); n > 0; n-- {
+		if strings.HasSuffix(s, doneMarker[:n]) {
+			return n
+		}
+	}
+	return 0
+}
+
+// errorFrame returns the error carried by an upstream SSE frame like
+// {"error": {"code": 503, "status": "UNAVAILABLE", ...}}, or nil for a normal chunk.
+func errorFrame(data []byte) error {
+	if !strings.Contains(string(data), `"error"`) {
+		return nil
+	}
+	var frame geminiError
+	if json.Unmarshal(data, &frame) != nil || (frame.Error.Code == 0 && frame.Error.Status == "") {
+		return nil
+	}
+	code := frame.Error.Code
+	if code == 0 {
+		code = 500
+	}
+	return &upstreamError{StatusCode: code, Body: data}
+}
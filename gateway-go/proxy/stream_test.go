@@ -0,0 +1,149 @@
+package proxy
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"gateway-go/converter"
+	"gateway-go/token"
+)
+
+// sseBody renders text pieces as a Gemini SSE stream, the last frame finishing.
+func sseBody(pieces []string, finish bool) string {
+	var b strings.Builder
+	for i, piece := range pieces {
+		cand := map[string]any{
+			"content": map[string]any{"role": "model", "parts": []any{map[string]any{"text": piece}}},
+			"index":   0,
+		}
+		if finish && i == len(pieces)-1 {
+			cand["finishReason"] = "STOP"
+		}
+		data, _ := json.Marshal(map[string]any{"candidates": []any{cand}})
+		b.WriteString("data: " + string(data) + "\r\n\r\n")
+	}
+	return b.String()
+}
+
+// forwardText streams pieces through forwardStream in marker mode and returns the
+// text the client receives and whether the marker was seen.
+func forwardText(t *testing.T, pieces []string, finish bool) (string, bool) {
+	t.Helper()
+	p := &Proxy{}
+	st := &streamState{
+		marker: true,
+		conv:   converter.NewStreamConverter("gemini-2.0-flash", "chatcmpl-1", 0),
+	}
+	resp := &http.Response{Body: io.NopCloser(strings.NewReader(sseBody(pieces, finish)))}
+	rec := httptest.NewRecorder()
+	if err := p.forwardStream(rec, rec, resp, st, "gemini-2.0-flash", "chatcmpl-1"); err != nil {
+		t.Fatal(err)
+	}
+
+	var text strings.Builder
+	scanner := bufio.NewScanner(rec.Body)
+	for scanner.Scan() {
+		line, ok := strings.CutPrefix(scanner.Text(), "data: ")
+		if !ok {
+			continue
+		}
+		var chunk converter.OpenAIResponse
+		if err := json.Unmarshal([]byte(line), &chunk); err != nil {
+			t.Fatal(err)
+		}
+		for _, c := range chunk.Choices {
+			if c.Delta != nil && c.Delta.Content != nil {
+				text.WriteString(*c.Delta.Content)
+			}
+		}
+	}
+	if st.collected.String() != text.String() {
+		t.Errorf("collected %q but sent %q", st.collected.String(), text.String())
+	}
+	return text.String(), st.foundDone
+}
+
+// splits returns every way to cut s into two and three pieces.
+func splits(s string) [][]string {
+	out := [][]string{{s}}
+	for i := 0; i <= len(s); i++ {
+		out = append(out, []string{s[:i], s[i:]})
+		for j := i; j <= len(s); j++ {
+			out = append(out, []string{s[:i], s[i:j], s[j:]})
+		}
+	}
+	return out
+}
+
+func TestMarkerSplitAcrossChunks(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		stream string
+		want   string
+		found  bool
+		finish bool
+	}{
+		{"marker at end", "The answer is 42.\n" + doneMarker, "The answer is 42.\n", true, true},
+		{"marker then whitespace", "All done." + doneMarker + "\n", "All done.\n", true, true},
+		{"marker in the middle", "Part one " + doneMarker + " part two", "Part one  part two", true, true},
+		{"no marker", "Nothing to strip here.", "Nothing to strip here.", false, true},
+		{"partial marker at end", "Look at [don", "Look at [don", false, true},
+		{"partial marker, no finish reason", "Look at [do", "Look at [do", false, false},
+		{"false start", "a [d [do [don [done x", "a [d [do [don [done x", false, true},
+		{"bracket before marker", "list[" + doneMarker, "list[", true, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			for _, pieces := range splits(tc.stream) {
+				got, found := forwardText(t, pieces, tc.finish)
+				if got != tc.want || found != tc.found {
+					t.Fatalf("pieces %q: got %q (found %v), want %q (found %v)", pieces, got, found, tc.want, tc.found)
+				}
+			}
+		})
+	}
+}
+
+func TestMarkerFilterFlush(t *testing.T) {
+	f := &markerFilter{}
+	if got := f.write("text [do"); got != "text " {
+		t.Errorf("write = %q, want %q", got, "text ")
+	}
+	if got := f.flush(); got != "[do" {
+		t.Errorf("flush = %q, want %q", got, "[do")
+	}
+	if f.found {
+		t.Error("marker reported found")
+	}
+}
+
+// After a failover each credential is charged for the segments it served.
+func TestEndSegmentShares(t *testing.T) {
+	st := &streamState{}
+	st.usage = &converter.GeminiUsage{PromptTokenCount: 100, CandidatesTokenCount: 40}
+	st.endSegment("a", 90)
+
+	// Cut off before Gemini reported usage: estimated
+	st.usage, st.segmentText = nil, 80
+	st.endSegment("b", 90)
+
+	st.usage, st.segmentText = &converter.GeminiUsage{PromptTokenCount: 150, CandidatesTokenCount: 10}, 0
+	st.endSegment("a", 90)
+
+	want := []token.Share{{CredID: "a", Input: 250, Output: 50}, {CredID: "b", Input: 90, Output: 20}}
+	if len(st.shares) != len(want) {
+		t.Fatalf("shares = %+v, want %+v", st.shares, want)
+	}
+	for i := range want {
+		if st.shares[i] != want[i] {
+			t.Errorf("share %d = %+v, want %+v", i, st.shares[i], want[i])
+		}
+	}
+	if st.promptTokens != 340 || st.outputTokens != 70 {
+		t.Errorf("totals = %d, %d; want 340, 70", st.promptTokens, st.outputTokens)
+	}
+}
@@ -0,0 +1,183 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"gateway-go/converter"
+)
+
+// TruncationMode selects how the proxy detects and repairs truncated answers.
+type TruncationMode string
+
+const (
+	// TruncationOff forwards the answer as the model produced it.
+	TruncationOff TruncationMode = "off"
+	// TruncationMarker asks the model to end with doneMarker and continues until it does.
+	TruncationMarker TruncationMode = "marker"
+	// TruncationFinishReason continues only when the upstream reports it hit its token limit.
+	TruncationFinishReason TruncationMode = "finish-reason"
+)
+
+// maxContinuationBudget caps any policy's continuation count, including per-request overrides.
+const maxContinuationBudget = 10
+
+// defaultContinuations is the budget of a policy spec that gives none.
+const defaultContinuations = 3
+
+// TruncationPolicy is an anti-truncation mode with its continuation budget.
+type TruncationPolicy struct {
+	Mode             TruncationMode
+	MaxContinuations int
+}
+
+func (p TruncationPolicy) String() string {
+	if p.Mode == TruncationOff {
+		return string(p.Mode)
+	}
+	return fmt.Sprintf("%s:%d", p.Mode, p.MaxContinuations)
+}
+
+// ParseTruncationPolicy parses "off", "marker", "finish-reason" or either of the last
+// two with a budget, e.g. "marker:5".
+func ParseTruncationPolicy(spec string) (TruncationPolicy, error) {
+	mode, budget, hasBudget := strings.Cut(strings.TrimSpace(spec), ":")
+	p := TruncationPolicy{Mode: TruncationMode(mode), MaxContinuations: defaultContinuations}
+
+	switch p.Mode {
+	case TruncationOff:
+		if hasBudget {
+			return TruncationPolicy{}, fmt.Errorf("anti-truncation policy %q: off takes no budget", spec)
+		}
+		p.MaxContinuations = 0
+		return p, nil
+	case TruncationMarker, TruncationFinishReason:
+	default:
+		return TruncationPolicy{}, fmt.Errorf("unknown anti-truncation policy %q", spec)
+	}
+
+	if hasBudget {
+		n, err := strconv.Atoi(budget)
+		if err != nil || n < 0 || n > maxContinuationBudget {
+			return TruncationPolicy{}, fmt.Errorf("anti-truncation policy %q: budget must be 0-%d", spec, maxContinuationBudget)
+		}
+		p.MaxContinuations = n
+	}
+	return p, nil
+}
+
+// TruncationConfig holds the default policy and per-model overrides, keyed by the
+// model name clients send.
+type TruncationConfig struct {
+	Default TruncationPolicy
+	Models  map[string]TruncationPolicy
+}
+
+// ParseTruncationConfig parses a default policy spec and a comma-separated list of
+// model=policy overrides, e.g. "gemini-2.0-flash=off,gemini-1.5-pro=finish-reason:5".
+func ParseTruncationConfig(defaultSpec, modelSpecs string) (TruncationConfig, error) {
+	def, err := ParseTruncationPolicy(defaultSpec)
+	if err != nil {
+		return TruncationConfig{}, err
+	}
+	cfg := TruncationConfig{Default: def, Models: make(map[string]TruncationPolicy)}
+
+	for _, entry := range strings.Split(modelSpecs, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		model, spec, ok := strings.Cut(entry, "=")
+		if !ok || model == "" {
+			return TruncationConfig{}, fmt.Errorf("anti-truncation override %q: want model=policy", entry)
+		}
+		p, err := ParseTruncationPolicy(spec)
+		if err != nil {
+			return TruncationConfig{}, err
+		}
+		cfg.Models[model] = p
+	}
+	return cfg, nil
+}
+
+// truncationHeader lowers the policy for one request; the anti_truncation body field
+// does the same for clients that can't set headers. The header wins.
+const truncationHeader = "X-Anti-Truncation"
+
+// modeStrength orders the modes by how much continuation they allow.
+var modeStrength = map[TruncationMode]int{
+	TruncationOff:          0,
+	TruncationFinishReason: 1,
+	TruncationMarker:       2,
+}
+
+// clamp limits a client's override to what p, the operator's policy, allows: the
+// client may pick a weaker mode or a smaller budget, never a stronger or larger one.
+func (p TruncationPolicy) clamp(override TruncationPolicy) TruncationPolicy {
+	if modeStrength[override.Mode] < modeStrength[p.Mode] {
+		p.Mode = override.Mode
+	}
+	if p.Mode == TruncationOff {
+		return TruncationPolicy{Mode: TruncationOff}
+	}
+	p.MaxContinuations = min(p.MaxContinuations, override.MaxContinuations)
+	return p
+}
+
+// policyFor resolves the policy for one request: the model's policy, else the
+// default, lowered by the header or else the body field. Marker mode is downgraded
+// to finish-reason for requests that offer tools, since the extra instruction
+// interferes with tool calls, and for requests that want JSON, which the marker
+// would break.
+func (c TruncationConfig) policyFor(r *http.Request, req *converter.OpenAIRequest) (TruncationPolicy, error) {
+	p, ok := c.Models[req.Model]
+	if !ok {
+		p = c.Default
+	}
+
+	spec := r.Header.Get(truncationHeader)
+	if spec == "" {
+		spec = req.AntiTruncation
+	}
+	if spec != "" {
+		override, err := ParseTruncationPolicy(spec)
+		if err != nil {
+			return TruncationPolicy{}, err
+		}
+		p = p.clamp(override)
+	}
+
+	if p.Mode == TruncationMarker && (len(req.Tools) > 0 || len(req.Functions) > 0 || req.ResponseFormat.JSON()) {
+		p.Mode = TruncationFinishReason
+	}
+	return p, nil
+}
+
+// blockedFinishReasons end an answer for policy reasons. Continuing would only ask the
+// model to produce the blocked content again.
+var blockedFinishReasons = map[string]bool{
+	"SAFETY":             true,
+	"RECITATION":         true,
+	"BLOCKLIST":          true,
+	"PROHIBITED_CONTENT": true,
+	"SPII":               true,
+}
+
+// needsContinuation reports whether a cleanly finished stream segment was truncated
+// according to policy. In marker mode any stop without the marker counts, MAX_TOKENS
+// included; a blocked answer is never continued.
+func needsContinuation(policy TruncationPolicy, st *streamState) bool {
+	if blockedFinishReasons[st.finishReason] {
+		return false
+	}
+	switch policy.Mode {
+	case TruncationMarker:
+		return !st.foundDone
+	case TruncationFinishReason:
+		return st.finishReason == "MAX_TOKENS"
+	default:
+		return false
+	}
+}
@@ -0,0 +1,64 @@
+package proxy
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"gateway-go/converter"
+)
+
+func TestPolicyForClampsOverride(t *testing.T) {
+	cfg, err := ParseTruncationConfig("marker:3", "flash=finish-reason:2,lite=off")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		name     string
+		model    string
+		header   string
+		body     string
+		want     string
+		tools    bool
+		jsonMode bool
+	}{
+		{"default", "pro", "", "", "marker:3", false, false},
+		{"model policy", "flash", "", "", "finish-reason:2", false, false},
+		{"lower budget", "pro", "marker:1", "", "marker:1", false, false},
+		{"raise budget", "pro", "marker:9", "", "marker:3", false, false},
+		{"disable", "pro", "off", "", "off", false, false},
+		{"weaker mode", "pro", "finish-reason:5", "", "finish-reason:3", false, false},
+		{"stronger mode", "flash", "marker:1", "", "finish-reason:1", false, false},
+		{"enable when off", "lite", "marker:5", "", "off", false, false},
+		{"body field", "pro", "", "marker:2", "marker:2", false, false},
+		{"header wins", "pro", "off", "marker:2", "off", false, false},
+		{"tools downgrade marker", "pro", "", "", "finish-reason:3", true, false},
+		{"json downgrades marker", "pro", "", "", "finish-reason:3", false, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest("POST", "/v1/chat/completions", nil)
+			if tc.header != "" {
+				r.Header.Set(truncationHeader, tc.header)
+			}
+			req := &converter.OpenAIRequest{Model: tc.model, AntiTruncation: tc.body}
+			if tc.tools {
+				req.Tools = []converter.OpenAITool{{Type: "function"}}
+			}
+			if tc.jsonMode {
+				req.ResponseFormat = &converter.ResponseFormat{Type: "json_object"}
+			}
+			p, err := cfg.policyFor(r, req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if p.String() != tc.want {
+				t.Errorf("policy = %s, want %s", p, tc.want)
+			}
+		})
+	}
+
+	r := httptest.NewRequest("POST", "/v1/chat/completions", nil)
+	r.Header.Set(truncationHeader, "always")
+	if _, err := cfg.policyFor(r, &converter.OpenAIRequest{Model: "pro"}); err == nil {
+		t.Error("invalid override accepted")
+	}
+}
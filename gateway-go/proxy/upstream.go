@@ -0,0 +1,113 @@
+package proxy
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"gateway-go/credential"
+)
+
+// upstreamError is a failed upstream call: either a non-200 response or, with
+// StatusCode 0, a transport error.
+type upstreamError struct {
+	StatusCode int
+	Header     http.Header
+	Body       []byte
+	Err        error // transport error, set when StatusCode is 0
+}
+
+func (e *upstreamError) Error() string {
+	if e.StatusCode == 0 {
+		return "upstream request failed: " + e.Err.Error()
+	}
+	return fmt.Sprintf("upstream error (status %d): %s", e.StatusCode, string(e.Body))
+}
+
+func (e *upstreamError) Unwrap() error { return e.Err }
+
+// geminiError is the error envelope Gemini returns on non-200 responses.
+type geminiError struct {
+	Error struct {
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+		Status  string `json:"status"`
+		Details []struct {
+			Type       string `json:"@type"`
+			Reason     string `json:"reason"`     // google.rpc.ErrorInfo
+			RetryDelay string `json:"retryDelay"` // google.rpc.RetryInfo, e.g. "17s" or "0.5s"
+		} `json:"details"`
+	} `json:"error"`
+}
+
+// failure classifies err for the credential's circuit breaker. Errors that are not
+// upstream responses (e.g. an unparsable 200 body) count as upstream failures.
+// The cooldown comes from RetryInfo, then Retry-After, then the message text.
+func failure(err error) credential.Failure {
+	var upErr *upstreamError
+	if !errors.As(err, &upErr) {
+		return credential.Failure{}
+	}
+
+	f := credential.Failure{StatusCode: upErr.StatusCode}
+	var gemErr geminiError
+	if json.Unmarshal(upErr.Body, &gemErr) == nil {
+		f.Status = gemErr.Error.Status
+		for _, d := range gemErr.Error.Details {
+			if f.Reason == "" && d.Reason != "" {
+				f.Reason = d.Reason
+			}
+			if f.Cooldown == 0 && d.RetryDelay != "" {
+				f.Cooldown = parseRetryDelay(d.RetryDelay)
+			}
+		}
+	}
+	if f.Cooldown == 0 {
+		f.Cooldown = parseRetryAfter(upErr.Header.Get("Retry-After"), time.Now())
+	}
+	if f.Cooldown == 0 {
+		// Last resort: an English hint in the message
+		if seconds := parseCooldown(string(upErr.Body)); seconds > 0 {
+			f.Cooldown = time.Duration(seconds) * time.Second
+		}
+	}
+	return f
+}
+
+// parseRetryDelay parses a RetryInfo retryDelay, a protobuf Duration in its JSON form
+// ("17s", "0.250s"). Returns 0 if it can't be parsed.
+func parseRetryDelay(s string) time.Duration {
+	if !strings.HasSuffix(s, "s") {
+		return 0
+	}
+	seconds, err := strconv.ParseFloat(strings.TrimSuffix(s, "s"), 64)
+	// NaN fails the first comparison; Inf and other out-of-range delays the second
+	if err != nil || !(seconds > 0) || seconds >= math.MaxInt64/float64(time.Second) {
+		return 0
+	}
+	return time.Duration(seconds * float64(time.Second))
+}
+
+// parseRetryAfter parses a Retry-After header in either delay-seconds or HTTP-date
+// form. Returns 0 if it is absent, malformed or already in the past.
+func parseRetryAfter(value string, now time.Time) time.Duration {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		if seconds <= 0 {
+			return 0
+		}
+		return time.Duration(seconds) * time.Second
+	}
+	if at, err := http.ParseTime(value); err == nil && at.After(now) {
+		return at.Sub(now)
+	}
+	return 0
+}
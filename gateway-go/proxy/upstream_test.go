@@ -0,0 +1,85 @@
+package proxy
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestParseRetryDelay(t *testing.T) {
+	for _, tc := range []struct {
+		in   string
+		want time.Duration
+	}{
+		{"17s", 17 * time.Second},
+		{"12.5s", 12500 * time.Millisecond},
+		{"0.250s", 250 * time.Millisecond},
+		{"0s", 0},
+		{"-3s", 0},
+		{"17", 0},
+		{"17ms", 0},
+		{"s", 0},
+		{"abcs", 0},
+		{"NaNs", 0},
+		{"Infs", 0},
+		{"1e30s", 0},
+		{"", 0},
+	} {
+		if got := parseRetryDelay(tc.in); got != tc.want {
+			t.Errorf("parseRetryDelay(%q) = %v, want %v", tc.in, got, tc.want)
+		}
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2025, 3, 1, 12, 0, 0, 0, time.UTC)
+	for _, tc := range []struct {
+		name, in string
+		want     time.Duration
+	}{
+		{"seconds", "120", 2 * time.Minute},
+		{"seconds with spaces", " 5 ", 5 * time.Second},
+		{"zero", "0", 0},
+		{"negative", "-10", 0},
+		{"HTTP-date", now.Add(90 * time.Second).Format(http.TimeFormat), 90 * time.Second},
+		{"RFC 850 date", now.Add(time.Hour).Format(time.RFC850), time.Hour},
+		{"past date", now.Add(-time.Minute).Format(http.TimeFormat), 0},
+		{"now", now.Format(http.TimeFormat), 0},
+		{"fractional seconds", "1.5", 0},
+		{"garbage", "soon", 0},
+		{"empty", "", 0},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := parseRetryAfter(tc.in, now); got != tc.want {
+				t.Errorf("parseRetryAfter(%q) = %v, want %v", tc.in, got, tc.want)
+			}
+		})
+	}
+}
+
+// RetryInfo takes precedence over Retry-After, which takes precedence over the message.
+func TestFailureCooldown(t *testing.T) {
+	const retryInfo = `{"error": {"code": 429, "status": "RESOURCE_EXHAUSTED", "message": "Quota exceeded, try again in 30 seconds.",
+		"details": [{"@type": "type.googleapis.com/google.rpc.RetryInfo", "retryDelay": "12.5s"}]}}`
+	const message = `{"error": {"code": 429, "status": "RESOURCE_EXHAUSTED", "message": "Quota exceeded, try again in 30 seconds."}}`
+	for _, tc := range []struct {
+		name, body, retryAfter string
+		want                   time.Duration
+	}{
+		{"RetryInfo", retryInfo, "60", 12500 * time.Millisecond},
+		{"Retry-After", message, "60", time.Minute},
+		{"message", message, "", 30 * time.Second},
+		{"none", `{"error": {"code": 429}}`, "", 0},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			header := http.Header{}
+			if tc.retryAfter != "" {
+				header.Set("Retry-After", tc.retryAfter)
+			}
+			f := failure(&upstreamError{StatusCode: 429, Header: header, Body: []byte(tc.body)})
+			if f.Cooldown != tc.want {
+				t.Errorf("cooldown = %v, want %v", f.Cooldown, tc.want)
+			}
+		})
+	}
+}
@@ -9,6 +9,7 @@ type Stats struct {
 	mu             sync.RWMutex
 	byCredential   map[string]*CounterPair
 	byModel        map[string]*CounterPair
+	byKey          map[string]*CounterPair // gateway API key; empty when auth is off
 	globalInput    atomic.Int64
 	globalOutput   atomic.Int64
 	globalRequests atomic.Int64
@@ -24,21 +25,48 @@ func NewStats() *Stats {
 	return &Stats{
 		byCredential: make(map[string]*CounterPair),
 		byModel:      make(map[string]*CounterPair),
+		byKey:        make(map[string]*CounterPair),
 	}
 }
 
-func (s *Stats) Record(credID, model string, inputTokens, outputTokens int) {
-	s.globalInput.Add(int64(inputTokens))
-	s.globalOutput.Add(int64(outputTokens))
-	s.globalRequests.Add(1)
+// Record attributes a finished request to its API key (may be empty), credential and model.
+func (s *Stats) Record(keyID, credID, model string, inputTokens, outputTokens int) {
+	s.RecordShared(keyID, model, []Share{{CredID: credID, Input: inputTokens, Output: outputTokens}})
+}
+
+// Share is the part of one request's tokens a single credential served.
+type Share struct {
+	CredID        string
+	Input, Output int
+}
 
-	s.getOrCreate(credID, model).Input.Add(int64(inputTokens))
-	s.getOrCreate(credID, model).Output.Add(int64(outputTokens))
-	s.getOrCreate(credID, model).Requests.Add(1)
+// RecordShared attributes a finished request whose segments were served by several
+// credentials, as after a failover. Each credential is charged its own share and
+// counts the request once; the key, model and global totals count it once overall.
+func (s *Stats) RecordShared(keyID, model string, shares []Share) {
+	var input, output int64
+	for _, sh := range shares {
+		cp := s.getOrCreate(sh.CredID, model)
+		cp.Input.Add(int64(sh.Input))
+		cp.Output.Add(int64(sh.Output))
+		cp.Requests.Add(1)
+		input += int64(sh.Input)
+		output += int64(sh.Output)
+	}
+
+	s.globalInput.Add(input)
+	s.globalOutput.Add(output)
+	s.globalRequests.Add(1)
 
-	s.getModelCounter(model).Input.Add(int64(inputTokens))
-	s.getModelCounter(model).Output.Add(int64(outputTokens))
+	s.getModelCounter(model).Input.Add(input)
+	s.getModelCounter(model).Output.Add(output)
 	s.getModelCounter(model).Requests.Add(1)
+
+	if keyID != "" {
+		s.getKeyCounter(keyID).Input.Add(input)
+		s.getKeyCounter(keyID).Output.Add(output)
+		s.getKeyCounter(keyID).Requests.Add(1)
+	}
 }
 
 func (s *Stats) getOrCreate(credID, _ string) *CounterPair {
@@ -77,6 +105,24 @@ func (s *Stats) getModelCounter(model string) *CounterPair {
 	return cp
 }
 
+func (s *Stats) getKeyCounter(keyID string) *CounterPair {
+	s.mu.RLock()
+	if cp, ok := s.byKey[keyID]; ok {
+		s.mu.RUnlock()
+		return cp
+	}
+	s.mu.RUnlock()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if cp, ok := s.byKey[keyID]; ok {
+		return cp
+	}
+	cp := &CounterPair{}
+	s.byKey[keyID] = cp
+	return cp
+}
+
 // EstimateInputTokens estimates input token count: chars/4 + images*300
 func EstimateInputTokens(text string, imageCount int) int {
 	tokens := len(text) / 4
@@ -109,6 +155,15 @@ func (s *Stats) GetSummary() map[string]any {
 		}
 	}
 
+	keyStats := make(map[string]map[string]int64)
+	for k, v := range s.byKey {
+		keyStats[k] = map[string]int64{
+			"input_tokens":  v.Input.Load(),
+			"output_tokens": v.Output.Load(),
+			"requests":      v.Requests.Load(),
+		}
+	}
+
 	return map[string]any{
 		"global": map[string]int64{
 			"input_tokens":  s.globalInput.Load(),
@@ -117,5 +172,6 @@ func (s *Stats) GetSummary() map[string]any {
 		},
 		"by_credential": credStats,
 		"by_model":      modelStats,
+		"by_key":        keyStats,
 	}
 }
@@ -191,7 +191,7 @@ test_gateway() {
 
   case "$GW_TYPE" in
     go)
-      START_CMD="cd ${REMOTE_DIR}/gateway-go && ${GO_ENV_PREFIX}${CPU_PREFIX}./gateway-go -port ${GW_PORT} -upstream http://${LOCAL_IP}:${MOCK_PORT} -creds ${CREDS}"
+      START_CMD="cd ${REMOTE_DIR}/gateway-go && ${GO_ENV_PREFIX}${CPU_PREFIX}./gateway-go -port ${GW_PORT} -upstream http://${LOCAL_IP}:${MOCK_PORT} -cred-store mock:${CREDS}"
       ;;
     node)
       START_CMD="cd ${REMOTE_DIR}/gateway-node && UPSTREAM_URL=http://${LOCAL_IP}:${MOCK_PORT} PORT=${GW_PORT} CRED_COUNT=${CREDS} ${CPU_PREFIX}node dist/index.js"
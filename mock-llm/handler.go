@@ -16,6 +16,11 @@ var (
 	configMu       sync.RWMutex
 	globalLatency  = "medium"
 	globalErrorRate float64 = 0.0
+
+	// Mid-stream faults: "drop" aborts the connection, "error" sends an error frame,
+	// "truncate" ends the stream early with MAX_TOKENS
+	globalStreamFault     = "none"
+	globalStreamFaultRate float64
 )
 
 // Gemini format structures
@@ -23,6 +28,7 @@ type GeminiRequest struct {
 	Contents         []GeminiContent        `json:"contents"`
 	GenerationConfig map[string]any         `json:"generationConfig,omitempty"`
 	Tools            []any                  `json:"tools,omitempty"`
+	SystemInstruction *GeminiContent        `json:"systemInstruction,omitempty"`
 }
 
 type GeminiContent struct {
@@ -59,15 +65,24 @@ type UsageMetadata struct {
 
 type ErrorResponse struct {
 	Error struct {
-		Code    int    `json:"code"`
-		Message string `json:"message"`
-		Status  string `json:"status"`
+		Code    int           `json:"code"`
+		Message string        `json:"message"`
+		Status  string        `json:"status"`
+		Details []ErrorDetail `json:"details,omitempty"`
 	} `json:"error"`
 }
 
+// ErrorDetail is a google.rpc status detail; only RetryInfo is emitted.
+type ErrorDetail struct {
+	Type       string `json:"@type"`
+	RetryDelay string `json:"retryDelay,omitempty"`
+}
+
 type ConfigRequest struct {
-	Latency   string  `json:"latency,omitempty"`
-	ErrorRate float64 `json:"errorRate,omitempty"`
+	Latency         string  `json:"latency,omitempty"`
+	ErrorRate       float64 `json:"errorRate,omitempty"`
+	StreamFault     string  `json:"streamFault,omitempty"`
+	StreamFaultRate float64 `json:"streamFaultRate,omitempty"`
 }
 
 func pickPreset(r *http.Request) Preset {
@@ -80,6 +95,46 @@ func pickPreset(r *http.Request) Preset {
 	return Presets[rand.Intn(len(Presets))]
 }
 
+// decodeRequest reads the request body; a malformed body yields an empty request.
+func decodeRequest(r *http.Request) *GeminiRequest {
+	var req GeminiRequest
+	json.NewDecoder(r.Body).Decode(&req)
+	return &req
+}
+
+// wantsDoneMarker reports whether the system instruction asks the model to end with
+// the gateway's [done] marker, which the mock then honours.
+func wantsDoneMarker(req *GeminiRequest) bool {
+	if req.SystemInstruction == nil {
+		return false
+	}
+	for _, part := range req.SystemInstruction.Parts {
+		if strings.Contains(part.Text, "[done]") {
+			return true
+		}
+	}
+	return false
+}
+
+// continuationTail returns the text quoted by a gateway continuation prompt. Like a
+// real model, the mock repeats it before carrying on.
+func continuationTail(req *GeminiRequest) string {
+	if len(req.Contents) == 0 {
+		return ""
+	}
+	last := req.Contents[len(req.Contents)-1]
+	for _, part := range last.Parts {
+		_, quoted, ok := strings.Cut(part.Text, "ending with:\n\"...")
+		if !ok {
+			continue
+		}
+		if tail, _, ok := strings.Cut(quoted, "\"\n"); ok {
+			return tail
+		}
+	}
+	return ""
+}
+
 func getLatency(r *http.Request) string {
 	if l := r.Header.Get("X-Mock-Latency"); l != "" {
 		return l
@@ -100,6 +155,19 @@ func getErrorRate(r *http.Request) float64 {
 	return globalErrorRate
 }
 
+// getStreamFault returns the fault to inject into this stream, or "none".
+func getStreamFault(r *http.Request) string {
+	if fault := r.Header.Get("X-Mock-Stream-Fault"); fault != "" {
+		return fault
+	}
+	configMu.RLock()
+	defer configMu.RUnlock()
+	if globalStreamFault != "none" && rand.Float64() < globalStreamFaultRate {
+		return globalStreamFault
+	}
+	return "none"
+}
+
 func applyLatency(latency string) {
 	switch latency {
 	case "fast":
@@ -137,11 +205,14 @@ func shouldError(errorRate float64) (bool, int) {
 
 func writeError(w http.ResponseWriter, code int) {
 	var msg, status string
+	var details []ErrorDetail
 	switch code {
 	case 429:
-		msg = fmt.Sprintf("Quota exceeded. Try again in %d seconds.", 5+rand.Intn(25))
+		delay := 5 + rand.Intn(25)
+		msg = fmt.Sprintf("Quota exceeded. Try again in %d seconds.", delay)
 		status = "RESOURCE_EXHAUSTED"
-		w.Header().Set("Retry-After", strconv.Itoa(5+rand.Intn(25)))
+		details = []ErrorDetail{{Type: "type.googleapis.com/google.rpc.RetryInfo", RetryDelay: fmt.Sprintf("%ds", delay)}}
+		w.Header().Set("Retry-After", strconv.Itoa(delay))
 	case 503:
 		msg = "Service temporarily unavailable. Please retry."
 		status = "UNAVAILABLE"
@@ -156,6 +227,7 @@ func writeError(w http.ResponseWriter, code int) {
 	resp.Error.Code = code
 	resp.Error.Message = msg
 	resp.Error.Status = status
+	resp.Error.Details = details
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(code)
 	json.NewEncoder(w).Encode(resp)
@@ -211,6 +283,18 @@ func handleGenerateContent(w http.ResponseWriter, r *http.Request) {
 	}
 
 	preset := pickPreset(r)
+	req := decodeRequest(r)
+	if wantsDoneMarker(req) {
+		preset.ResponseText += "\n[done]"
+	}
+	if tail := continuationTail(req); tail != "" {
+		preset.ResponseText = tail + preset.ResponseText
+	}
+	if req.GenerationConfig["responseMimeType"] == "application/json" {
+		// JSON mode: wrap the answer in an object
+		data, _ := json.Marshal(map[string]string{"text": preset.ResponseText})
+		preset.ResponseText = string(data)
+	}
 	latency := getLatency(r)
 	applyLatency(latency)
 
@@ -232,6 +316,18 @@ func handleStreamGenerateContent(w http.ResponseWriter, r *http.Request) {
 	}
 
 	preset := pickPreset(r)
+	req := decodeRequest(r)
+	if wantsDoneMarker(req) {
+		preset.ResponseText += "\n[done]"
+	}
+	if tail := continuationTail(req); tail != "" {
+		preset.ResponseText = tail + preset.ResponseText
+	}
+	if req.GenerationConfig["responseMimeType"] == "application/json" {
+		// JSON mode: wrap the answer in an object
+		data, _ := json.Marshal(map[string]string{"text": preset.ResponseText})
+		preset.ResponseText = string(data)
+	}
 	latency := getLatency(r)
 
 	// Apply first-token latency
@@ -251,9 +347,35 @@ func handleStreamGenerateContent(w http.ResponseWriter, r *http.Request) {
 	text := preset.ResponseText
 	chunks := splitIntoChunks(text)
 
+	fault := getStreamFault(r)
+	faultAt := -1
+	if fault != "none" {
+		faultAt = rand.Intn(len(chunks))
+	}
+
 	for i, chunk := range chunks {
 		isLast := i == len(chunks)-1
 
+		if i == faultAt {
+			switch fault {
+			case "error":
+				resp := ErrorResponse{}
+				resp.Error.Code = 503
+				resp.Error.Message = "The model is overloaded. Please try again later."
+				resp.Error.Status = "UNAVAILABLE"
+				data, _ := json.Marshal(resp)
+				fmt.Fprintf(w, "data: %s\n\n", data)
+				flusher.Flush()
+				return
+			case "drop":
+				// Abort the connection without terminating the chunked body
+				panic(http.ErrAbortHandler)
+			case "truncate":
+				// End cleanly but early, as if the output token limit was hit
+				isLast = true
+			}
+		}
+
 		candidate := GeminiCandidate{
 			Content: GeminiContent{
 				Parts: []GeminiPart{{Text: chunk}},
@@ -268,6 +390,9 @@ func handleStreamGenerateContent(w http.ResponseWriter, r *http.Request) {
 
 		if isLast {
 			resp.Candidates[0].FinishReason = "STOP"
+			if i == faultAt {
+				resp.Candidates[0].FinishReason = "MAX_TOKENS"
+			}
 			resp.UsageMetadata = &UsageMetadata{
 				PromptTokenCount:     preset.InputTokens,
 				CandidatesTokenCount: preset.OutputTokens,
@@ -275,7 +400,7 @@ func handleStreamGenerateContent(w http.ResponseWriter, r *http.Request) {
 			}
 
 			// Add tool call as separate part in last chunk if applicable
-			if preset.ToolCall != nil {
+			if preset.ToolCall != nil && i != faultAt {
 				resp.Candidates[0].Content.Parts = append(resp.Candidates[0].Content.Parts, GeminiPart{
 					FunctionCall: &FunctionCall{
 						Name: preset.ToolCall.FunctionName,
@@ -289,11 +414,12 @@ func handleStreamGenerateContent(w http.ResponseWriter, r *http.Request) {
 		fmt.Fprintf(w, "data: %s\n\n", data)
 		flusher.Flush()
 
-		if !isLast {
-			// Random delay between chunks: 20-100ms
-			delay := 20 + rand.Intn(80)
-			time.Sleep(time.Duration(delay) * time.Millisecond)
+		if isLast {
+			return
 		}
+		// Random delay between chunks: 20-100ms
+		delay := 20 + rand.Intn(80)
+		time.Sleep(time.Duration(delay) * time.Millisecond)
 	}
 }
 
@@ -319,6 +445,27 @@ func isUTF8Start(b byte) bool {
 	return b&0xC0 != 0x80
 }
 
+// OAuth client expected by the token endpoint; empty values are not checked.
+var (
+	oauthClientID     string
+	oauthClientSecret string
+)
+
+type oauthError struct {
+	Error            string `json:"error"`
+	ErrorDescription string `json:"error_description,omitempty"`
+}
+
+func writeOAuthError(w http.ResponseWriter, code int, errCode, desc string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(oauthError{Error: errCode, ErrorDescription: desc})
+}
+
+// handleTokenRefresh implements the RFC 6749 refresh-token grant. Refresh tokens are
+// accepted if they start with "mock_refresh_" and do not contain "revoked"; every
+// successful grant rotates the refresh token.
 func handleTokenRefresh(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
@@ -328,20 +475,66 @@ func handleTokenRefresh(w http.ResponseWriter, r *http.Request) {
 	// Simulate OAuth token refresh with fixed 50ms delay
 	time.Sleep(50 * time.Millisecond)
 
+	if !strings.HasPrefix(r.Header.Get("Content-Type"), "application/x-www-form-urlencoded") {
+		writeOAuthError(w, 400, "invalid_request", "body must be application/x-www-form-urlencoded")
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		writeOAuthError(w, 400, "invalid_request", "malformed form body")
+		return
+	}
+
+	// Client authentication: client_secret_basic or client_secret_post
+	clientID, clientSecret, hasBasic := r.BasicAuth()
+	if !hasBasic {
+		clientID = r.PostForm.Get("client_id")
+		clientSecret = r.PostForm.Get("client_secret")
+	}
+	if (oauthClientID != "" && clientID != oauthClientID) ||
+		(oauthClientSecret != "" && clientSecret != oauthClientSecret) {
+		w.Header().Set("WWW-Authenticate", `Basic realm="mock-llm"`)
+		writeOAuthError(w, 401, "invalid_client", "client authentication failed")
+		return
+	}
+
+	if grantType := r.PostForm.Get("grant_type"); grantType != "refresh_token" {
+		writeOAuthError(w, 400, "unsupported_grant_type", fmt.Sprintf("grant_type %q is not supported", grantType))
+		return
+	}
+	refreshToken := r.PostForm.Get("refresh_token")
+	if refreshToken == "" {
+		writeOAuthError(w, 400, "invalid_request", "missing refresh_token")
+		return
+	}
+	if !strings.HasPrefix(refreshToken, "mock_refresh_") || strings.Contains(refreshToken, "revoked") {
+		writeOAuthError(w, 400, "invalid_grant", "refresh token is invalid, expired or revoked")
+		return
+	}
+
 	errorRate := getErrorRate(r)
 	// Use a lower error rate for token refresh (1/5 of normal)
 	if shouldErr, code := shouldError(errorRate / 5); shouldErr {
-		writeError(w, code)
+		switch code {
+		case 429, 503:
+			writeOAuthError(w, 503, "temporarily_unavailable", "token service overloaded")
+		case 400:
+			writeOAuthError(w, 400, "invalid_request", "simulated malformed request")
+		default:
+			writeOAuthError(w, 400, "invalid_grant", "simulated revoked grant")
+		}
 		return
 	}
 
+	now := time.Now().UnixNano()
 	resp := map[string]any{
-		"access_token": fmt.Sprintf("mock_token_%d", time.Now().UnixNano()),
-		"expires_in":   3600,
-		"token_type":   "Bearer",
+		"access_token":  fmt.Sprintf("mock_token_%d", now),
+		"expires_in":    3600,
+		"token_type":    "Bearer",
+		"refresh_token": fmt.Sprintf("mock_refresh_%d", now),
 	}
 
 	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
 	json.NewEncoder(w).Encode(resp)
 }
 
@@ -350,8 +543,10 @@ func handleConfig(w http.ResponseWriter, r *http.Request) {
 	case http.MethodGet:
 		configMu.RLock()
 		resp := map[string]any{
-			"latency":    globalLatency,
-			"error_rate": globalErrorRate,
+			"latency":           globalLatency,
+			"error_rate":        globalErrorRate,
+			"stream_fault":      globalStreamFault,
+			"stream_fault_rate": globalStreamFaultRate,
 		}
 		configMu.RUnlock()
 		w.Header().Set("Content-Type", "application/json")
@@ -373,6 +568,15 @@ func handleConfig(w http.ResponseWriter, r *http.Request) {
 		if req.ErrorRate >= 0 && req.ErrorRate <= 1 {
 			globalErrorRate = req.ErrorRate
 		}
+		if req.StreamFault != "" {
+			valid := map[string]bool{"none": true, "drop": true, "error": true, "truncate": true}
+			if valid[req.StreamFault] {
+				globalStreamFault = req.StreamFault
+			}
+		}
+		if req.StreamFaultRate >= 0 && req.StreamFaultRate <= 1 {
+			globalStreamFaultRate = req.StreamFaultRate
+		}
 		configMu.Unlock()
 
 		w.Header().Set("Content-Type", "application/json")
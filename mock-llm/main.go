@@ -9,6 +9,8 @@ import (
 
 func main() {
 	port := flag.Int("port", 8081, "Server port")
+	flag.StringVar(&oauthClientID, "client-id", "", "OAuth client ID required by /oauth2/token (any if empty)")
+	flag.StringVar(&oauthClientSecret, "client-secret", "", "OAuth client secret required by /oauth2/token (any if empty)")
 	flag.Parse()
 
 	router := newRouter()